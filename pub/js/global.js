@@ -1,6 +1,8 @@
 var va = {};
 va.templates = {};
 va.processingVideoIds = {};
+va.filters = {};
+va.listUrl = "/videos";
 
 va.randomPlaylistIndex = 0;
 va.randomPlaylist = [];
@@ -9,14 +11,33 @@ va.checkProcessingVideos = function() {
   _.each(_.keys(va.processingVideoIds), function(id, callback) {
     $.get("/video/" + id, function(data) {
       if (data.Status === 'Ready') {
-        va.renderVideo(va.processingVideoIds[id], id, data);
+        va.renderVideo(id, data);
         delete va.processingVideoIds[id];
+      } else if (data.Status === 'Failed') {
+        va.updateVideoStatus(id, data);
+      } else {
+        va.updateJobStatus(id);
       }
     });
    }, function(err) {
    });
 };
 
+va.updateJobStatus = function(id) {
+  $.get("/video/" + id + "/job", function(job) {
+    var status = "Videos processing...";
+    if (job.State === "queued") {
+      status = "Waiting to process...";
+    } else if (job.State === "running") {
+      status = "Processing " + Math.round(job.Progress) + "%";
+      if (job.Eta > 0) {
+        status += " (" + va.durationToString(job.Eta) + " left)";
+      }
+    }
+    $("#video_" + id + " .status").html(status);
+  });
+};
+
 va.durationToString = function(durationSeconds) {
   var total = parseInt(durationSeconds, 10);
   var secs = total % 60;
@@ -51,8 +72,8 @@ va.playVideo = function(id) {
   $("#player")[0].load();
   $("#player")[0].play();
   var metadata = videoElem.data("metadata");
-  $("#player_title").html(metadata.Title);
-  $("#player_description").html(metadata.Description);
+  $("#player_title").text(metadata.Title);
+  $("#player_description").text(metadata.Description);
   $("#player_container").show();
 };
 
@@ -65,29 +86,36 @@ va.closePlayer = function() {
 va.fetchVideos = function() {
   va.randomPlaylist = [];
   va.randomPlaylistIndex = 0;
-  va.fetchVideosInternal(0, true);
+  va.fetchVideosInternal("", true);
 };
 
-va.fetchVideosInternal = function(skip, getAll) {
-  $.get("/videos?skip=" + skip + "&limit=50", function(data) {
+va.fetchVideosInternal = function(cursor, getAll) {
+  var params = _.extend({cursor: cursor, limit: 50}, va.filters);
+  $.get(va.listUrl, params, function(data) {
     var render = function() {
       if (!va.documentReady) {
         setTimeout(render, 250);
         return;
       }
 
-      var keys = _.keys(data.Ids).sort().reverse();
-      _.each(keys, function(k) {        
+      var videos = _.map(_.keys(data.Ids), function(k) {
         var videoData = JSON.parse(data.Ids[k]);
-        if (videoData.Status === "Ready") {
-          va.randomPlaylist.push(k);
+        videoData.Urls = data.Urls[k];
+        return {id: k, data: videoData};
+      });
+      videos = _.sortBy(videos, function(v) {
+        return -v.data.DateTaken;
+      });
+      _.each(videos, function(v) {
+        if (v.data.Status === "Ready") {
+          va.randomPlaylist.push(v.id);
         }
-        va.renderVideo(data.Bucket, k, videoData);
+        va.renderVideo(v.id, v.data);
       });
       va.randomPlaylist = _.shuffle(va.randomPlaylist);
 
-      if (getAll && data.Remaining > 0) {
-        va.fetchVideosInternal(skip + keys.length, true);
+      if (getAll && data.NextCursor) {
+        va.fetchVideosInternal(data.NextCursor, true);
       }
     };
 
@@ -95,6 +123,56 @@ va.fetchVideosInternal = function(skip, getAll) {
   });
 };
 
+// Reloads the archive showing only videos whose title, description or file
+// name contain the search box's text.
+va.search = function() {
+  var query = $.trim($("#search_query").val());
+  va.listUrl = "/videos";
+  va.filters = query ? {q: query} : {};
+  $("#videos").html("");
+  $("#time_nav").html("Loading...");
+  va.fetchVideos();
+};
+
+// Shows videos with the given filters, e.g. {tag: "beach"}.
+va.filterBy = function(filters) {
+  $("#search_query").val("");
+  va.listUrl = "/videos";
+  va.filters = filters;
+  $("#videos").html("");
+  $("#time_nav").html("Loading...");
+  va.fetchVideos();
+};
+
+// Shows the videos in the trash, which can be restored until they're
+// purged.
+va.showTrash = function() {
+  $("#search_query").val("");
+  va.listUrl = "/trash";
+  va.filters = {};
+  $("#videos").html("");
+  $("#time_nav").html("Loading...");
+  va.fetchVideos();
+};
+
+va.fetchTags = function() {
+  $.get("/tags", function(data) {
+    var tagNav = $("#tag_nav").html("");
+    _.each([["tag", data.Tags], ["person", data.People]], function(pair) {
+      _.each(pair[1], function(label) {
+        var link = $("<a href='javascript:void(0)'></a>").text(
+            label.Name + " (" + label.Count + ")");
+        link.click(function() {
+          var filters = {};
+          filters[pair[0]] = label.Name;
+          va.filterBy(filters);
+        });
+        tagNav.append($("<div></div>").append(link));
+      });
+    });
+  });
+};
+
 va.getProcessingVideosContainer = function() {
   var containerId = "container_processing";
   var container = $("#"+ containerId);
@@ -107,8 +185,15 @@ va.getProcessingVideosContainer = function() {
   return container;
 };
 
-va.renderVideo = function(bucket, id, data) {
-  var dateTaken = new Date(parseInt(id.split("_")[0], 10) * 1000);
+// Appends a cache busting parameter to url, which may already have a query
+// string if it is signed.
+va.cacheBust = function(url) {
+  var cacheVersion = $.cookie("cacheVersion") || "0";
+  return url + (url.indexOf("?") === -1 ? "?" : "&") + "_=" + cacheVersion;
+};
+
+va.renderVideo = function(id, data) {
+  var dateTaken = new Date(data.DateTaken * 1000);
   var year = dateTaken.getYear();
   var month = dateTaken.getMonth();
   var container = null;
@@ -152,16 +237,17 @@ va.renderVideo = function(bucket, id, data) {
 
   var existing = $("#video_" + id);
   var rendered = va.templates.video({
-      bucket: bucket,
       id: id,
-      cacheVersion: $.cookie("cacheVersion") || "0"
+      thumbUrl: va.cacheBust(data.Urls.Thumb),
+      video360Url: va.cacheBust(data.Urls.Video360),
+      video720Url: va.cacheBust(data.Urls.Video720),
+      video1080Url: va.cacheBust(data.Urls.Video1080)
   });
   if (existing.length > 0) {
     existing.replaceWith(rendered);
   } else {
     container.append(rendered);
   }
-  $("#video_" + id).data("bucket", bucket);
   $("#video_" + id).data("metadata", data);
 
   va.updateVideoStatus(id, data);
@@ -169,23 +255,153 @@ va.renderVideo = function(bucket, id, data) {
 
 va.updateVideoStatus = function(id, data) {
   delete va.processingVideoIds[id];
-  $("#video_" + id + " .title").html(data.Title);
-  $("#video_" + id + " .description").html(data.Description);
+  $("#video_" + id + " .title").text(data.Title);
+  $("#video_" + id + " .description").text(data.Description);
+  $("#video_" + id + " .labels").text(
+      (data.Tags || []).concat(data.People || []).join(", "));
   $("#video_" + id + " .duration").html(
       "(" + va.durationToString(data.Duration) + ")");
   $("#video_" + id + " .tools").hide();
-  if (data.Status !== 'Ready') {
+  if (data.DateDeleted) {
+    $("#video_" + id + " .delete").hide();
+    $("#video_" + id + " .status").html(
+        "In the trash. " +
+        "<a href=\"javascript:va.restoreVideo('" + id + "')\">restore</a>"
+        ).show();
+  } else if (data.Status === 'Failed') {
+    $("#video_" + id + " .links").css('display', 'none');
+    $("#video_" + id + " .status").html(
+        "Processing failed. " +
+        "<a class=\"uploader-only\" " +
+        "href=\"javascript:va.retryVideo('" + id + "')\">retry</a>").attr(
+        "title", data.Error || "").show();
+  } else if (data.Status !== 'Ready') {
     $("#video_" + id + " .links").css('display', 'none');
     $("#video_" + id + " .status").html("Videos processing...").show();
     $("#video_" + id + " .links a").attr("href", 
         "javascript:alert('Video not ready yet')");
-    va.processingVideoIds[id] = $("#video_" + id).data("bucket");
+    va.processingVideoIds[id] = true;
   } else {
     $("#video_" + id + " .links").css('display', 'inline-block');
     $("#video_" + id + " .status").hide();
+    $("#video_" + id + " .links .original").toggle(!!data.Original);
   }
 };
 
+// Sends file straight to S3 a part at a time, then has the server process
+// it.  Progress is shown in the #uploading_<id> row.
+va.uploadDirect = function(file, id, force) {
+  var row = $("#uploading_" + id);
+  var failed = function(xhr) {
+    row.find(".progress").html("Error").attr("title",
+        (xhr && xhr.responseText) || "");
+  };
+  var complete = function(upload) {
+    $.post("/upload/s3/" + upload.Id + "/complete", {
+      force: force ? "1" : ""
+    }).done(function() {
+      va.watchDirectUpload(row, upload.Id);
+    }).fail(failed);
+  };
+  var sendPart = function(upload, n, retries) {
+    if (n > upload.Parts) {
+      complete(upload);
+      return;
+    }
+    var start = (n - 1) * upload.PartSize;
+    var end = n === upload.Parts ? file.size : start + upload.PartSize;
+    var retry = function(xhr) {
+      if (retries < 3) {
+        setTimeout(function() {
+          sendPart(upload, n, retries + 1);
+        }, 1000 * (retries + 1));
+      } else {
+        failed(xhr);
+      }
+    };
+    $.getJSON("/upload/s3/" + upload.Id + "/part/" + n, function(part) {
+      var xhr = new XMLHttpRequest();
+      xhr.open("PUT", part.Url);
+      xhr.upload.onprogress = function(e) {
+        row.find(".progress").html(
+            Math.round((start + e.loaded) / file.size * 100) + "%");
+      };
+      xhr.onload = function() {
+        if (xhr.status === 200) {
+          sendPart(upload, n + 1, 0);
+        } else {
+          retry(xhr);
+        }
+      };
+      xhr.onerror = function() {
+        retry(xhr);
+      };
+      xhr.send(file.slice(start, end));
+    }).fail(retry);
+  };
+
+  $.ajax({
+    url: "/upload/s3",
+    type: "POST",
+    contentType: "application/json",
+    data: JSON.stringify({Filename: file.name, Size: file.size})
+  }).done(function(upload) {
+    sendPart(upload, 1, 0);
+  }).fail(failed);
+};
+
+// Polls a direct upload while the server processes it, showing how it went
+// in row.
+va.watchDirectUpload = function(row, id) {
+  row.find(".progress").html("Processing...");
+  $.getJSON("/upload/s3/" + id, function(upload) {
+    if (upload.State === "Complete" && upload.Result.Duplicate) {
+      row.find(".progress").html("Already in the archive");
+    } else if (upload.State === "Complete") {
+      row.remove();
+      va.fetchVideos();
+    } else if (upload.State === "Failed") {
+      row.find(".progress").html("Processing failed. ").attr(
+          "title", upload.Error).append(
+          $("<a href='javascript:void(0)'>retry</a>").click(function() {
+            $.post("/upload/s3/" + id + "/retry", function() {
+              va.watchDirectUpload(row, id);
+            });
+          }));
+    } else {
+      setTimeout(function() {
+        va.watchDirectUpload(row, id);
+      }, 5000);
+    }
+  });
+};
+
+// Shows direct uploads still being processed, or that failed, from before
+// the page was loaded.
+va.fetchDirectUploads = function() {
+  $.getJSON("/upload/s3", function(uploads) {
+    var render = function() {
+      if (!va.documentReady || !va.templatesLoaded) {
+        setTimeout(render, 250);
+        return;
+      }
+      _.each(uploads, function(upload) {
+        if (upload.State !== "Completing" && upload.State !== "Failed") {
+          return;
+        }
+        va.getProcessingVideosContainer().append(
+            va.templates.uploading_video({
+              filename: upload.Filename,
+              id: upload.Id
+            }));
+        va.watchDirectUpload($("#uploading_" + upload.Id), upload.Id);
+      });
+    };
+
+    render();
+  });
+};
+
 va.prepareTemplates = function() {
   async.each([
     "uploading_video",
@@ -201,7 +417,7 @@ va.prepareTemplates = function() {
 };
 
 va.rotateVideo = function(id, degrees) {
-  $.get("/video/" + id + "/rotate/" + degrees, function(data) {
+  $.post("/video/" + id + "/rotate/" + degrees, function(data) {
     $.cookie("cacheVersion", new Date().getTime());
     $.get("/video/" + id, function(data) {
       va.updateVideoStatus(id, data);
@@ -210,7 +426,7 @@ va.rotateVideo = function(id, degrees) {
 };
 
 va.stripRotateTag = function(id, degrees) {
-  $.get("/video/" + id + "/stripRotateTag", function(data) {
+  $.post("/video/" + id + "/stripRotateTag", function(data) {
     $.cookie("cacheVersion", new Date().getTime());
     $.get("/video/" + id, function(data) {
       va.updateVideoStatus(id, data);
@@ -218,16 +434,80 @@ va.stripRotateTag = function(id, degrees) {
   });
 };
 
+va.retryVideo = function(id) {
+  $.post("/video/" + id + "/retry", function(data) {
+    $.get("/video/" + id, function(data) {
+      va.updateVideoStatus(id, data);
+    });
+  }).fail(function(xhr) {
+    alert("Could not retry: " + xhr.responseText);
+  });
+};
+
 va.deleteVideo = function(id, degrees) {
-  if (window.confirm("Are you sure you want to delete this video?")) {
-    $.get("/video/" + id + "/delete", function(data) {
+  if (window.confirm("Move this video to the trash?")) {
+    $.post("/video/" + id + "/delete", function(data) {
       $("#video_" + id).remove();
     });
   }
 };
 
+va.restoreVideo = function(id) {
+  $.post("/video/" + id + "/restore", function(data) {
+    $("#video_" + id).remove();
+  }).fail(function(xhr) {
+    alert("Could not restore: " + xhr.responseText);
+  });
+};
+
 va.toggleEdit = function(id) {
-  $("#video_" + id + " .tools").toggle();
+  var videoElem = $("#video_" + id);
+  var metadata = videoElem.data("metadata");
+  videoElem.find(".edit-title").val(metadata.Title);
+  videoElem.find(".edit-description").val(metadata.Description);
+  videoElem.find(".edit-tags").val((metadata.Tags || []).join(", "));
+  videoElem.find(".edit-people").val((metadata.People || []).join(", "));
+  videoElem.find(".edit-date").val(
+      va.formatDate(new Date(metadata.DateTaken * 1000)));
+  videoElem.find(".tools").toggle();
+};
+
+va.formatDate = function(date) {
+  var pad = function(n) {
+    return n < 10 ? "0" + n : "" + n;
+  };
+  return date.getFullYear() + "-" + pad(date.getMonth() + 1) + "-" +
+      pad(date.getDate()) + " " + pad(date.getHours()) + ":" +
+      pad(date.getMinutes());
+};
+
+va.saveVideo = function(id) {
+  var videoElem = $("#video_" + id);
+  var dateTaken = new Date(
+      $.trim(videoElem.find(".edit-date").val()).replace(" ", "T"));
+  if (isNaN(dateTaken.getTime())) {
+    alert("Date must look like YYYY-MM-DD HH:MM");
+    return;
+  }
+  $.ajax({
+    url: "/video/" + id,
+    type: "PUT",
+    contentType: "application/json",
+    data: JSON.stringify({
+      Title: videoElem.find(".edit-title").val(),
+      Description: videoElem.find(".edit-description").val(),
+      DateTaken: Math.round(dateTaken.getTime() / 1000),
+      Tags: videoElem.find(".edit-tags").val().split(","),
+      People: videoElem.find(".edit-people").val().split(",")
+    }),
+    success: function(data) {
+      va.renderVideo(id, data);
+      va.fetchTags();
+    },
+    error: function(xhr) {
+      alert("Could not save: " + xhr.responseText);
+    }
+  });
 };
 
 va.toggleYear = function(navYearId) {
@@ -244,27 +524,56 @@ va.gotoMonth = function(containerId) {
 $(function() {    
   va.documentReady = true;
 
+  // Our session has expired, so log in again
+  $(document).ajaxError(function(event, xhr) {
+    if (xhr.status == 401) {
+      window.location = "/login?next=" + encodeURIComponent(
+          window.location.pathname);
+    }
+  });
+
   var r = new Resumable({
     target:'/upload', 
-    query: {
-      upload_token:'my_token'
+    query: function(file) {
+      return {
+        upload_token:'my_token',
+        force: file.force ? '1' : ''
+      };
     },
-    simultaneousUploads: 1
+    simultaneousUploads: 1,
+    // Bad or conflicting chunks won't get better by sending them again
+    permanentErrors: [400, 404, 409, 415, 500, 501]
   });
   r.assignBrowse(document.getElementById('browseButton'));
   r.assignDrop(document.getElementById('main'));
   r.on('fileAdded', function(file, event){
+    file.force = $("#upload_force").is(":checked");
     va.getProcessingVideosContainer().append(va.templates.uploading_video({
       filename: file.fileName,
       id: file.uniqueIdentifier
     }));
+    if ($("body").data("direct-uploads")) {
+      r.removeFile(file);
+      va.uploadDirect(file.file, file.uniqueIdentifier, file.force);
+      return;
+    }
     r.upload();
   });
   r.on('fileProgress', function(file) {
     $("#uploading_" + file.uniqueIdentifier + " .progress").html(
         Math.round(file.progress() * 100) + "%");
   });
-  r.on('fileSuccess', function(file) {
+  r.on('fileSuccess', function(file, message) {
+    var result = {};
+    try {
+      result = JSON.parse(message);
+    } catch (e) {
+    }
+    if (result.Duplicate) {
+      $("#uploading_" + file.uniqueIdentifier + " .progress").html(
+          "Already in the archive");
+      return;
+    }
     $("#uploading_" + file.uniqueIdentifier).remove();
     va.fetchVideos();
   });
@@ -272,14 +581,24 @@ $(function() {
     $("#uploading_" + file.uniqueIdentifier + " .progress").html("Error");
   });
 
+  $("#search_query").keypress(function(e) {
+    if (e.which === 13) {
+      va.search();
+    }
+  });
+
   $("#player")[0].addEventListener("ended", function() {
     va.playRandom();
   });
 
+  if ($("body").data("direct-uploads")) {
+    va.fetchDirectUploads();
+  }
   setInterval(va.checkProcessingVideos, 15000);
 });
 va.prepareTemplates();
 va.fetchVideos();
+va.fetchTags();
 
 Date.prototype.getMonthName = function(lang) {
     lang = lang && (lang in Date.locale) ? lang : 'en';
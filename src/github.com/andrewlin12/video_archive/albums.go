@@ -0,0 +1,365 @@
+package main
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "path"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+  "github.com/gorilla/mux"
+)
+
+// An Album is a named, ordered group of videos in a library.  Albums are
+// stored alongside the videos as albums/<id>.json, and a video can be in
+// any number of them.
+type Album struct {
+  Id string
+  Title string
+  Description string
+  VideoIds []string
+  CoverVideoId string
+  DateCreated int64
+  DateUpdated int64
+}
+
+// AlbumJson is an album as returned by the API, with URLs for its cover and,
+// when a single album is requested, its videos.
+type AlbumJson struct {
+  Album
+  CoverUrl string
+  Videos map[string]VideoJson `json:",omitempty"`
+}
+
+// An AlbumEdit is the body of POST /albums and PUT /albums/{id}.  When
+// updating, fields left out are not changed.
+type AlbumEdit struct {
+  Title *string
+  Description *string
+  VideoIds *[]string
+  CoverVideoId *string
+}
+
+// albumMutex serializes read-modify-write cycles on album files.
+var albumMutex sync.Mutex
+
+func containsString(list []string, s string) bool {
+  for _, item := range list {
+    if item == s {
+      return true
+    }
+  }
+  return false
+}
+
+func albumKey(id string) string {
+  return "albums/" + id + ".json"
+}
+
+// newId returns a random hex id that is hard to guess.
+func newId() string {
+  b := make([]byte, 12)
+  _, err := rand.Read(b)
+  if err != nil {
+    panic(err)
+  }
+  return hex.EncodeToString(b)
+}
+
+func (lib *Library) getAlbum(id string) (Album, error) {
+  var album Album
+  data, err := lib.storage.Get(albumKey(id))
+  if err != nil {
+    return album, err
+  }
+  err = json.Unmarshal(data, &album)
+  return album, err
+}
+
+func (lib *Library) putAlbum(album Album) error {
+  data, err := json.Marshal(album)
+  if err != nil {
+    return err
+  }
+  return lib.storage.Put(albumKey(album.Id), data, "text/json")
+}
+
+func (lib *Library) listAlbums() ([]Album, error) {
+  keys, _, err := listAll(lib.storage, "albums/", "")
+  if err != nil {
+    return nil, err
+  }
+  albums := []Album{}
+  for _, key := range keys {
+    album, err := lib.getAlbum(strings.TrimSuffix(path.Base(key), ".json"))
+    if err != nil {
+      fmt.Printf("Skipping album %s: %v\n", key, err)
+      continue
+    }
+    albums = append(albums, album)
+  }
+  sort.Sort(albumsByTitle(albums))
+  return albums, nil
+}
+
+type albumsByTitle []Album
+
+func (s albumsByTitle) Len() int { return len(s) }
+func (s albumsByTitle) Less(i, j int) bool {
+  return strings.ToLower(s[i].Title) < strings.ToLower(s[j].Title)
+}
+func (s albumsByTitle) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// apply validates edit and applies it to album, which is in lib.
+func (edit AlbumEdit) apply(lib *Library, album *Album) error {
+  if edit.Title != nil {
+    title := strings.TrimSpace(*edit.Title)
+    if title == "" {
+      return fmt.Errorf("Title can't be empty")
+    } else if len(title) > 200 {
+      return fmt.Errorf("Title must be at most 200 characters")
+    }
+    album.Title = title
+  }
+  if edit.Description != nil {
+    if len(*edit.Description) > 5000 {
+      return fmt.Errorf("Description must be at most 5000 characters")
+    }
+    album.Description = *edit.Description
+  }
+  if edit.VideoIds != nil {
+    videoIds := []string{}
+    seen := make(map[string]bool)
+    for _, id := range *edit.VideoIds {
+      if seen[id] {
+        continue
+      }
+      if _, ok := lib.index.Get(id); !ok {
+        return fmt.Errorf("No video %s", id)
+      }
+      seen[id] = true
+      videoIds = append(videoIds, id)
+    }
+    album.VideoIds = videoIds
+  }
+  if edit.CoverVideoId != nil {
+    album.CoverVideoId = *edit.CoverVideoId
+  }
+
+  // The cover has to be one of the album's videos; default to the first
+  if album.CoverVideoId != "" && !containsString(album.VideoIds,
+      album.CoverVideoId) {
+    if edit.CoverVideoId != nil {
+      return fmt.Errorf("Cover video must be in the album")
+    }
+    album.CoverVideoId = ""
+  }
+  if album.CoverVideoId == "" && len(album.VideoIds) > 0 {
+    album.CoverVideoId = album.VideoIds[0]
+  }
+  return nil
+}
+
+func (lib *Library) getAlbumJson(album Album, withVideos bool) AlbumJson {
+  result := AlbumJson{Album: album}
+  if album.CoverVideoId != "" {
+    result.CoverUrl = lib.storage.URL(thumbKey(album.CoverVideoId))
+  }
+  if withVideos {
+    result.Videos = make(map[string]VideoJson)
+    for _, id := range album.VideoIds {
+      metadata, ok := lib.index.Get(id)
+      if !ok || metadata.DateDeleted != 0 {
+        continue
+      }
+      result.Videos[id] = VideoJson{
+        VideoMetadata: metadata,
+        Urls: lib.getVideoUrls(id),
+      }
+    }
+  }
+  return result
+}
+
+func readAlbumEdit(w http.ResponseWriter, r *http.Request) (AlbumEdit,
+    bool) {
+  var edit AlbumEdit
+  err := json.NewDecoder(io.LimitReader(r.Body, 1024 * 1024)).Decode(&edit)
+  if err != nil {
+    http.Error(w, "Invalid JSON body", 400)
+    return edit, false
+  }
+  return edit, true
+}
+
+func albums(w http.ResponseWriter, r *http.Request) {
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  list, err := lib.listAlbums()
+  if err != nil {
+    fmt.Printf("Could not list albums: %v\n", err)
+    http.Error(w, "Could not list albums", 500)
+    return
+  }
+  result := []AlbumJson{}
+  for _, album := range list {
+    result = append(result, lib.getAlbumJson(album, false))
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(result)
+}
+
+func createAlbum(w http.ResponseWriter, r *http.Request) {
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  edit, ok := readAlbumEdit(w, r)
+  if !ok {
+    return
+  }
+  if edit.Title == nil {
+    http.Error(w, "Title is required", 400)
+    return
+  }
+
+  now := time.Now().Unix()
+  album := Album{
+    Id: newId(),
+    VideoIds: []string{},
+    DateCreated: now,
+    DateUpdated: now,
+  }
+  err := edit.apply(lib, &album)
+  if err != nil {
+    http.Error(w, err.Error(), 400)
+    return
+  }
+  err = lib.putAlbum(album)
+  if err != nil {
+    fmt.Printf("Could not save album: %v\n", err)
+    http.Error(w, "Could not save album", 500)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(201)
+  json.NewEncoder(w).Encode(lib.getAlbumJson(album, true))
+}
+
+func album(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  album, err := lib.getAlbum(vars["id"])
+  if err != nil {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(lib.getAlbumJson(album, true))
+}
+
+func editAlbum(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  edit, ok := readAlbumEdit(w, r)
+  if !ok {
+    return
+  }
+
+  albumMutex.Lock()
+  defer albumMutex.Unlock()
+
+  album, err := lib.getAlbum(vars["id"])
+  if err != nil {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+  err = edit.apply(lib, &album)
+  if err != nil {
+    http.Error(w, err.Error(), 400)
+    return
+  }
+  album.DateUpdated = time.Now().Unix()
+  err = lib.putAlbum(album)
+  if err != nil {
+    fmt.Printf("Could not save album: %v\n", err)
+    http.Error(w, "Could not save album", 500)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(lib.getAlbumJson(album, true))
+}
+
+func deleteAlbum(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  albumMutex.Lock()
+  defer albumMutex.Unlock()
+
+  _, err := lib.getAlbum(vars["id"])
+  if err != nil {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+  err = lib.storage.Delete(albumKey(vars["id"]))
+  if err != nil {
+    fmt.Printf("Could not delete album: %v\n", err)
+    http.Error(w, "Could not delete album", 500)
+    return
+  }
+  fmt.Fprintf(w, "Deleted")
+}
+
+// removeFromAlbums takes basename out of every album that has it, picking
+// a new cover where it was the cover.
+func (lib *Library) removeFromAlbums(basename string) {
+  albumMutex.Lock()
+  defer albumMutex.Unlock()
+
+  list, err := lib.listAlbums()
+  if err != nil {
+    fmt.Printf("Could not list albums: %v\n", err)
+    return
+  }
+  for _, album := range list {
+    if !containsString(album.VideoIds, basename) {
+      continue
+    }
+    videoIds := []string{}
+    for _, id := range album.VideoIds {
+      if id != basename {
+        videoIds = append(videoIds, id)
+      }
+    }
+    album.VideoIds = videoIds
+    if album.CoverVideoId == basename {
+      album.CoverVideoId = ""
+      if len(videoIds) > 0 {
+        album.CoverVideoId = videoIds[0]
+      }
+    }
+    album.DateUpdated = time.Now().Unix()
+    err = lib.putAlbum(album)
+    if err != nil {
+      fmt.Printf("Could not update album %s: %v\n", album.Id, err)
+    }
+  }
+}
@@ -3,16 +3,20 @@ package main
 import (
   "bufio"
   "crypto/md5"
+  "crypto/sha256"
+  "encoding/hex"
   "encoding/json"
   "flag"
   "fmt"
   "html/template"
   "io"
   "io/ioutil"
+  "mime"
   "net/http"
   "os"
   "os/exec"
   "path"
+  "sort"
   "strconv"
   "strings"
   "sync"
@@ -26,6 +30,23 @@ type JsonConfig struct {
   AccessKey string
   SecretKey string
   BucketName string
+  Region string
+  S3Endpoint string
+  Private bool
+  SignedUrlTtl int
+  Storage string
+  LocalStorageDir string
+  JobsDir string
+  MaxJobAttempts int
+  DoneJobRetentionDays int
+  TranscodeWorkers int
+  CookieSecret string
+  UsersFile string
+  TrashRetentionDays int
+  UploadDir string
+  MultipartThresholdMB int
+  StaleUploadHours int
+  OriginalStorageClass string
 }
 
 type VideoMetadata struct {
@@ -36,16 +57,58 @@ type VideoMetadata struct {
   Status string
   DateTaken int64
   DateUploaded int64
+  Tags []string
+  People []string
+
+  // Set when Status is Failed
+  Error string `json:",omitempty"`
+  ErrorDetail string `json:",omitempty"`
+  DateFailed int64 `json:",omitempty"`
+
+  // Set while the video is in the trash
+  DateDeleted int64 `json:",omitempty"`
+
+  // Original is the key of the file as uploaded, which renditions are
+  // remade from.  Width, Height and SourceRotation describe it as stored.
+  Original string `json:",omitempty"`
+  Sha256 string `json:",omitempty"`
+  Width int `json:",omitempty"`
+  Height int `json:",omitempty"`
+  SourceRotation string `json:",omitempty"`
+
+  // Rotation is added to SourceRotation when rendering, unless the
+  // original's rotate tag is being ignored.
+  Rotation int `json:",omitempty"`
+  IgnoreRotateTag bool `json:",omitempty"`
 }
 
 var config JsonConfig
 var s3Auth aws.Auth
-var uploadMutex *sync.Mutex
-var ffmpegMutex *sync.Mutex
+var s3Region aws.Region
+var storage Storage
+var libraries *LibrarySet
+var ingestLocks *KeyedMutex
+var uploadSessions *UploadSessions
+var metadataMutex *sync.Mutex
+var jobQueue *JobQueue
+var users *UserStore
+var sessions *SessionStore
 
 func main() {
-  uploadMutex = &sync.Mutex{}
-  ffmpegMutex = &sync.Mutex{}
+  var port = flag.Int("port", 3000, "Port to listen for requests");
+  var rebuildIndex = flag.Bool("rebuild-index", false,
+      "Rebuild the video index from each video's metadata.json");
+  var addUsername = flag.String("adduser", "",
+      "Add a user, or reset their password, reading it from stdin");
+  var addRole = flag.String("role", "",
+      "Role for -adduser: viewer, uploader or admin");
+  var addLibrary = flag.String("library", "",
+      "Library for -adduser, \"\" for the default one");
+  flag.Parse()
+
+  ingestLocks = NewKeyedMutex()
+  uploadSessions = NewUploadSessions()
+  metadataMutex = &sync.Mutex{}
 
   // Read config from disk
   configFile, e := ioutil.ReadFile("./config.json")
@@ -53,25 +116,184 @@ func main() {
     fmt.Printf("Must have config.json\n")
     os.Exit(1)
   }
+  config = JsonConfig{
+    Region: aws.USEast.Name,
+    SignedUrlTtl: 12 * 60 * 60,
+    Storage: "s3",
+    LocalStorageDir: "./storage",
+    JobsDir: "./jobs",
+    MaxJobAttempts: 5,
+    DoneJobRetentionDays: 7,
+    TranscodeWorkers: 1,
+    UsersFile: "./users.json",
+    TrashRetentionDays: 30,
+    UploadDir: "./staging",
+    MultipartThresholdMB: 100,
+    StaleUploadHours: 24,
+  }
   json.Unmarshal(configFile, &config)
   fmt.Printf("AccessKey: %s\n", config.AccessKey)
   fmt.Printf("SecretKey: %s\n", config.SecretKey)
   fmt.Printf("BucketName: %s\n", config.BucketName)
+  fmt.Printf("Region: %s\n", config.Region)
+
+  var err error
+  users, err = LoadUserStore(config.UsersFile)
+  if err != nil {
+    fmt.Printf("Could not load users: %v\n", err)
+    os.Exit(1)
+  }
+  if *addUsername != "" {
+    // NOTE: -library="" is meaningful, so check whether it was passed
+    var library *string
+    flag.Visit(func(f *flag.Flag) {
+      if f.Name == "library" {
+        library = addLibrary
+      }
+    })
+    err = addUser(*addUsername, *addRole, library)
+    if err != nil {
+      fmt.Printf("Could not add user: %v\n", err)
+      os.Exit(1)
+    }
+    return
+  }
+  if users.Len() == 0 {
+    fmt.Printf("No users in %s, add one with -adduser\n", config.UsersFile)
+  }
+  sessions = NewSessionStore()
+  err = os.MkdirAll(config.UploadDir, 0700)
+  if err != nil {
+    fmt.Printf("Could not create %s: %v\n", config.UploadDir, err)
+    os.Exit(1)
+  }
 
   s3Auth = aws.Auth{
       AccessKey: config.AccessKey,
       SecretKey: config.SecretKey,
   }
 
+  s3Region, err = getS3Region()
+  if err != nil {
+    fmt.Printf("%v\n", err)
+    os.Exit(1)
+  }
+
+  storage, err = newStorage()
+  if err != nil {
+    fmt.Printf("Could not open storage: %v\n", err)
+    os.Exit(1)
+  }
+
+  libraries = NewLibrarySet(*rebuildIndex)
+  for _, user := range users.List() {
+    _, err = libraries.Open(user.Library)
+    if err != nil {
+      fmt.Printf("Could not open library %q: %v\n", user.Library, err)
+      os.Exit(1)
+    }
+  }
+
+  err = initCookieSecret()
+  if err != nil {
+    fmt.Printf("Bad cookieSecret: %v\n", err)
+    os.Exit(1)
+  }
+
+  // Pick up any transcodes that were in flight when we last stopped
+  jobQueue, err = NewJobQueue(config.JobsDir, config.MaxJobAttempts)
+  if err != nil {
+    fmt.Printf("Could not open job journal: %v\n", err)
+    os.Exit(1)
+  }
+  jobQueue.Start(config.TranscodeWorkers)
+  go purgeTrashForever()
+  go cleanUpForever()
+
   // Set up web routes
   router := mux.NewRouter()
-  router.HandleFunc("/", index).Methods("GET")
-  router.HandleFunc("/upload", handleUpload)
-  router.HandleFunc("/video/{id}/stripRotateTag", stripRotateTag)
-  router.HandleFunc("/video/{id}/rotate/{degrees}", rotate)
-  router.HandleFunc("/video/{id}/delete", deleteVideo)
-  router.HandleFunc("/video/{id}", video)
-  router.HandleFunc("/videos", videos)
+  router.HandleFunc("/login", login)
+  router.HandleFunc("/logout", logout).Methods("POST")
+  router.HandleFunc("/", requireLogin(index)).Methods("GET")
+  router.HandleFunc("/me", requireLogin(me)).Methods("GET")
+
+  // Viewers can watch
+  router.HandleFunc("/video/{id}/job", requireRole(RoleViewer,
+      videoJob)).Methods("GET")
+  router.HandleFunc("/video/{id}", requireRole(RoleViewer, video)).Methods(
+      "GET")
+  router.HandleFunc("/videos", requireRole(RoleViewer, videos))
+  router.HandleFunc("/jobs", requireRole(RoleViewer, jobs)).Methods("GET")
+  router.HandleFunc("/tags", requireRole(RoleViewer, tags)).Methods("GET")
+  router.HandleFunc("/albums", requireRole(RoleViewer, albums)).Methods(
+      "GET")
+  router.HandleFunc("/albums/{id}", requireRole(RoleViewer, album)).Methods(
+      "GET")
+  router.HandleFunc("/video/{id}/original", requireRole(RoleViewer,
+      downloadOriginal)).Methods("GET")
+
+  // Uploaders can add videos and change their metadata
+  router.HandleFunc("/upload", requireRole(RoleUploader, handleUpload))
+  router.HandleFunc("/upload/s3", requireRole(RoleUploader,
+      startDirectUpload)).Methods("POST")
+  router.HandleFunc("/upload/s3", requireRole(RoleUploader,
+      listDirectUploads)).Methods("GET")
+  router.HandleFunc("/upload/s3/{id}", requireRole(RoleUploader,
+      directUploadStatus)).Methods("GET")
+  router.HandleFunc("/upload/s3/{id}/retry", requireRole(RoleUploader,
+      retryDirectUpload)).Methods("POST")
+  router.HandleFunc("/upload/s3/{id}/part/{n}", requireRole(RoleUploader,
+      directUploadPart)).Methods("GET")
+  router.HandleFunc("/upload/s3/{id}/complete", requireRole(RoleUploader,
+      completeDirectUpload)).Methods("POST")
+  router.HandleFunc("/upload/s3/{id}", requireRole(RoleUploader,
+      abortDirectUpload)).Methods("DELETE")
+  router.HandleFunc("/video/{id}/retry", requireRole(RoleUploader,
+      retryVideo)).Methods("POST")
+  router.HandleFunc("/video/{id}", requireRole(RoleUploader,
+      editVideo)).Methods("PUT")
+  router.HandleFunc("/labels", requireRole(RoleUploader,
+      labelVideos)).Methods("POST")
+  router.HandleFunc("/albums", requireRole(RoleUploader,
+      createAlbum)).Methods("POST")
+  router.HandleFunc("/albums/{id}", requireRole(RoleUploader,
+      editAlbum)).Methods("PUT")
+  router.HandleFunc("/albums/{id}", requireRole(RoleUploader,
+      deleteAlbum)).Methods("DELETE")
+  router.HandleFunc("/share", requireRole(RoleUploader,
+      createShare)).Methods("POST")
+  router.HandleFunc("/shares", requireRole(RoleUploader, shares)).Methods(
+      "GET")
+  router.HandleFunc("/share/{token}", requireRole(RoleUploader,
+      deleteShare)).Methods("DELETE")
+
+  // Admins can change or destroy videos and manage users
+  router.HandleFunc("/video/{id}/stripRotateTag", requireRole(RoleAdmin,
+      stripRotateTag)).Methods("POST")
+  router.HandleFunc("/video/{id}/rotate/{degrees}", requireRole(RoleAdmin,
+      rotate)).Methods("POST")
+  router.HandleFunc("/video/{id}/delete", requireRole(RoleAdmin,
+      deleteVideo)).Methods("POST")
+  router.HandleFunc("/video/{id}/restore", requireRole(RoleAdmin,
+      restoreVideo)).Methods("POST")
+  router.HandleFunc("/video/{id}/reprocess", requireRole(RoleAdmin,
+      reprocessVideo)).Methods("POST")
+  router.HandleFunc("/trash", requireRole(RoleAdmin, trash)).Methods("GET")
+  router.HandleFunc("/multipart", requireRole(RoleAdmin,
+      listMultipartUploads)).Methods("GET")
+  router.HandleFunc("/multipart/{id}", requireRole(RoleAdmin,
+      abortMultipartUpload)).Methods("DELETE")
+  router.HandleFunc("/users", requireRole(RoleAdmin, listUsers)).Methods(
+      "GET")
+  router.HandleFunc("/users", requireRole(RoleAdmin, createUser)).Methods("POST")
+  router.HandleFunc("/users/{name}", requireRole(RoleAdmin,
+      editUser)).Methods("PUT")
+  router.HandleFunc("/users/{name}", requireRole(RoleAdmin,
+      deleteUser)).Methods("DELETE")
+
+  // Share links are public, guarded by their own token and password
+  router.HandleFunc("/s/{token}/file/{key:.+}", shareFile).Methods("GET")
+  router.HandleFunc("/s/{token}", sharePage)
 
   // Static routes
   pubFileServer := http.FileServer(http.Dir("./pub/"))
@@ -79,187 +301,471 @@ func main() {
     prefix := fmt.Sprintf("/%s", path)
     router.PathPrefix(prefix).Handler(pubFileServer).Methods("GET")
   }
+  if localStorage, ok := storage.(*LocalStorage); ok {
+    router.PathPrefix(localStorage.urlPrefix).HandlerFunc(
+        requireLogin(serveLocalStorage(localStorage))).Methods("GET")
+  }
 
   http.Handle("/", router)
 
-  var port = flag.Int("port", 3000, "Port to listen for requests");
-  flag.Parse()
-
   fmt.Printf("Listening on %d...\n", *port);
   http.ListenAndServe(fmt.Sprintf(":%d", *port), nil);
 }
 
+// getS3Region looks up the configured region, or builds one around a custom
+// endpoint for S3-compatible stores.  Custom endpoints are addressed
+// path-style, since they rarely have per-bucket DNS.
+func getS3Region() (aws.Region, error) {
+  if config.S3Endpoint != "" {
+    return aws.Region{
+      Name: config.Region,
+      S3Endpoint: strings.TrimSuffix(config.S3Endpoint, "/"),
+    }, nil
+  }
+  region, ok := aws.Regions[config.Region]
+  if !ok {
+    return region, fmt.Errorf("Unknown region %q", config.Region)
+  }
+  return region, nil
+}
+
 func getS3Bucket() *s3.Bucket {
   // Connect to S3
-  s3Connection := s3.New(s3Auth, aws.USEast)
+  s3Connection := s3.New(s3Auth, s3Region)
   s3Bucket := s3Connection.Bucket(config.BucketName)
   return s3Bucket
 }
 
-var templates, _ = template.New("index").ParseFiles("./tmpl/index.html")
+func renditionKey(basename string, size string) string {
+  return fmt.Sprintf("%s/%s_%s.mp4", basename, basename, size)
+}
+
+func thumbKey(basename string) string {
+  return fmt.Sprintf("%s/%s_thumb.jpg", basename, basename)
+}
+
+// workPath returns where the local file name goes while uploads and jobs
+// work on it.
+func workPath(name string) string {
+  return path.Join(config.UploadDir, name)
+}
+
+// originalKey is where the upload of a video is kept.  ext is the uploaded
+// file's extension.
+func originalKey(basename string, ext string) string {
+  return fmt.Sprintf("%s/%s_original%s", basename, basename,
+      strings.ToLower(ext))
+}
+
+type VideoUrls struct {
+  Thumb string
+  Video360 string
+  Video720 string
+  Video1080 string
+}
+
+func (lib *Library) getVideoUrls(basename string) VideoUrls {
+  return VideoUrls{
+    Thumb: lib.storage.URL(thumbKey(basename)),
+    Video360: lib.storage.URL(renditionKey(basename, "360")),
+    Video720: lib.storage.URL(renditionKey(basename, "720")),
+    Video1080: lib.storage.URL(renditionKey(basename, "1080")),
+  }
+}
+
+func readMetadata(store Storage, basename string) (VideoMetadata, error) {
+  var metadata VideoMetadata
+  data, err := store.Get(basename + "/metadata.json")
+  if err != nil {
+    return metadata, err
+  }
+  err = json.Unmarshal(data, &metadata)
+  return metadata, err
+}
+
+func (lib *Library) getMetadata(basename string) (VideoMetadata, error) {
+  return readMetadata(lib.storage, basename)
+}
+
+func (lib *Library) putMetadata(basename string,
+    metadata VideoMetadata) error {
+  jsonMetadata, err := json.Marshal(metadata)
+  if err != nil {
+    return err
+  }
+  err = lib.storage.Put("/" + basename + "/metadata.json",
+      []byte(jsonMetadata), "text/json")
+  if err != nil {
+    return err
+  }
+  return lib.index.Set(basename, metadata)
+}
+
+// updateMetadata applies update to basename's metadata and writes it back.
+// Updates are serialized, so a job finishing can't undo an edit made while
+// it ran or vice versa.
+func (lib *Library) updateMetadata(basename string,
+    update func(*VideoMetadata) error) (VideoMetadata, error) {
+  metadataMutex.Lock()
+  defer metadataMutex.Unlock()
+
+  metadata, err := lib.getMetadata(basename)
+  if err != nil {
+    return metadata, err
+  }
+  err = update(&metadata)
+  if err != nil {
+    return metadata, err
+  }
+  return metadata, lib.putMetadata(basename, metadata)
+}
+
+func (lib *Library) setStatus(basename string,
+    status string) (VideoMetadata, error) {
+  return lib.updateMetadata(basename, func(metadata *VideoMetadata) error {
+    metadata.Status = status
+    metadata.Error = ""
+    metadata.ErrorDetail = ""
+    metadata.DateFailed = 0
+    return nil
+  })
+}
+
+// markVideoFailed is called once a job for basename has used up its
+// retries, so the failure shows up in the archive instead of the video
+// sitting in Processing forever.
+func (lib *Library) markVideoFailed(basename string, message string,
+    detail string) {
+  _, err := lib.updateMetadata(basename, func(metadata *VideoMetadata) error {
+    metadata.Status = "Failed"
+    metadata.Error = message
+    metadata.ErrorDetail = detail
+    metadata.DateFailed = time.Now().Unix()
+    return nil
+  })
+  if err != nil {
+    fmt.Printf("Could not mark %s failed: %v\n", basename, err)
+    return
+  }
+  fmt.Printf("Failed metadata written\n")
+}
+
+var templates, _ = template.New("index").ParseFiles("./tmpl/index.html",
+    "./tmpl/share.html", "./tmpl/login.html")
+type IndexPage struct {
+  UserJson
+  DirectUploads bool
+}
+
 func index(w http.ResponseWriter, r *http.Request) {
-  templates.ExecuteTemplate(w, "index.html", nil)
+  user, _ := currentUser(r)
+  _, directUploads := s3Bucket()
+  templates.ExecuteTemplate(w, "index.html", IndexPage{
+    UserJson: user.toJson(),
+    DirectUploads: directUploads,
+  })
 }
 
 type VideosJson struct {
   Bucket string
   Ids map[string]string
+  Urls map[string]VideoUrls
   Remaining int
+  NextCursor string
 }
+
+// videos returns a page of videos matching the filter parameters (see
+// parseVideoFilter), newest first.  Pass the previous page's NextCursor as
+// ?cursor= to get the videos that follow it.
 func videos(w http.ResponseWriter, r *http.Request) {
-  qs := r.URL.Query()
-  skip := 0
-  if qs["skip"] != nil {
-    skip64, err := strconv.ParseInt(qs["skip"][0], 10, 32)
-    if err != nil {
-      http.Error(w, "Invalid 'skip' parameter", 400)
-      return
-    }
-    skip = int(skip64)
+  filter, err := parseVideoFilter(r.URL.Query())
+  if err != nil {
+    http.Error(w, err.Error(), 400)
+    return
   }
+  listVideos(w, r, filter)
+}
+
+// listVideos writes the page of videos matching filter that r asks for.
+func listVideos(w http.ResponseWriter, r *http.Request, filter VideoFilter) {
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  qs := r.URL.Query()
+  cursor := qs.Get("cursor")
   limit := 1000
   if qs["limit"] != nil {
     limit64, err := strconv.ParseInt(qs["limit"][0], 10, 32)
-    if err != nil {
+    if err != nil || limit64 < 0 {
       http.Error(w, "Invalid 'limit' parameter", 400)
       return
     }
     limit = int(limit64)
   }
 
-  s3Bucket := getS3Bucket()
-  res, _ := s3Bucket.List("", "/", "", 1000)
-  maxLimit := len(res.CommonPrefixes) - skip
-  if limit > maxLimit {
-    limit = maxLimit
+  list := lib.index.Search(filter)
+  start := 0
+  if cursor != "" {
+    start = sort.Search(len(list), func(i int) bool {
+      return list[i].SortKey() < cursor
+    })
   }
-  startIndex := len(res.CommonPrefixes) - skip - limit
-  if startIndex < 0 {
-    startIndex = 0
+  end := start + limit
+  if end > len(list) {
+    end = len(list)
   }
-  prefixes := res.CommonPrefixes[startIndex:startIndex + limit]
   keys := make(map[string]string)
-  var wg sync.WaitGroup
-  i := len(prefixes) - 1
-  for i >= 0 {
-    j := 0
-    for j < 50 {
-      if i - j < 0 {
-        break
-      }
-      v := prefixes[i - j]
-      key := strings.Replace(v, "/", "", -1)
-      wg.Add(1)
-      go func(key string) {
-        resp, err := http.Get(
-            fmt.Sprintf("http://s3.amazonaws.com/%s/%s/metadata.json",
-            config.BucketName, key))
-        if err != nil {
-          fmt.Printf("%v\n", err)
-        } else {
-          defer resp.Body.Close()
-          body, _ := ioutil.ReadAll(resp.Body)
-          keys[key] = string(body)
-        }
-        wg.Done()
-      }(key)
-      j++
-    }
-    wg.Wait()
-    i -= j 
+  urls := make(map[string]VideoUrls)
+  for _, v := range list[start:end] {
+    jsonMetadata, _ := json.Marshal(v.Metadata)
+    keys[v.Id] = string(jsonMetadata)
+    urls[v.Id] = lib.getVideoUrls(v.Id)
+  }
+
+  nextCursor := ""
+  if end < len(list) && end > start {
+    nextCursor = list[end - 1].SortKey()
   }
 
   w.Header().Set("Content-Type", "application/json")
   json.NewEncoder(w).Encode(VideosJson{
     Bucket: config.BucketName,
     Ids: keys,
-    Remaining: startIndex,
+    Urls: urls,
+    Remaining: len(list) - end,
+    NextCursor: nextCursor,
   })
 }
 
+type VideoJson struct {
+  VideoMetadata
+  Urls VideoUrls
+}
+
 func video(w http.ResponseWriter, r *http.Request) {
   vars := mux.Vars(r)
-  s3Bucket := getS3Bucket()
-  data, err := s3Bucket.Get(vars["id"] + "/metadata.json")
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  metadata, err := lib.getMetadata(vars["id"])
   if err != nil {
     http.Error(w, "Not Found", 404)
     return
   }
   w.Header().Set("Content-Type", "application/json")
-  w.Write(data)
+  json.NewEncoder(w).Encode(VideoJson{
+    VideoMetadata: metadata,
+    Urls: lib.getVideoUrls(vars["id"]),
+  })
 }
 
-func handleUpload(w http.ResponseWriter, r *http.Request) {
-  id := r.FormValue("resumableIdentifier")
-  chunkNum, _ := strconv.ParseInt(r.FormValue("resumableChunkNumber"),
-      10, 32)
+// A VideoEdit is the body of PUT /video/{id}.  Fields left out are not
+// changed, and Tags and People replace the video's existing lists.
+type VideoEdit struct {
+  Title *string
+  Description *string
+  DateTaken *int64
+  Tags *[]string
+  People *[]string
+}
 
-  folderPath := fmt.Sprintf("/tmp/%s", id)
-  filePath := fmt.Sprintf("%s/%08d", folderPath, chunkNum)
-  if r.Method == "GET" {
-    _, err := os.Stat(filePath)
+func (edit *VideoEdit) validate() error {
+  if edit.Title != nil {
+    title := strings.TrimSpace(*edit.Title)
+    if title == "" {
+      return fmt.Errorf("Title can't be empty")
+    } else if len(title) > 200 {
+      return fmt.Errorf("Title must be at most 200 characters")
+    }
+  }
+  if edit.Description != nil && len(*edit.Description) > 5000 {
+    return fmt.Errorf("Description must be at most 5000 characters")
+  }
+  if edit.DateTaken != nil {
+    if *edit.DateTaken <= 0 {
+      return fmt.Errorf("DateTaken must be a unix timestamp")
+    } else if *edit.DateTaken > time.Now().Add(24 * time.Hour).Unix() {
+      return fmt.Errorf("DateTaken can't be in the future")
+    }
+  }
+  if edit.Tags != nil {
+    tags, err := normalizeLabels(*edit.Tags, true)
     if err != nil {
-      http.Error(w, "No Content", 204)
-      return
+      return err
     }
-
-    fmt.Fprintf(w, "Found")
-  } else if r.Method == "POST" {
-    err := os.Mkdir(folderPath, 0744)
-    file, _, err := r.FormFile("file")
+    edit.Tags = &tags
+  }
+  if edit.People != nil {
+    people, err := normalizeLabels(*edit.People, false)
     if err != nil {
-      http.Error(w, "Could not read form data", 500)
-      return
+      return err
     }
+    edit.People = &people
+  }
+  return nil
+}
 
-    data, err := ioutil.ReadAll(file)
-    if err != nil {
-      fmt.Printf("Could not get form file: %v", err)
-      http.Error(w, "Could not read file", 500)
-      return
+func editVideo(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  basename := vars["id"]
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  if _, ok := lib.index.Get(basename); !ok {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+
+  var edit VideoEdit
+  err := json.NewDecoder(io.LimitReader(r.Body, 64 * 1024)).Decode(&edit)
+  if err != nil {
+    http.Error(w, "Invalid JSON body", 400)
+    return
+  }
+  err = edit.validate()
+  if err != nil {
+    http.Error(w, err.Error(), 400)
+    return
+  }
+
+  // NOTE: Jobs write the whole metadata.json when they finish, so wait
+  //       until they are done rather than racing them
+  if jobQueue.HasActiveJob(lib.Name, basename) {
+    http.Error(w, "Video is being processed", 409)
+    return
+  }
+
+  metadata, err := lib.updateMetadata(basename,
+      func(metadata *VideoMetadata) error {
+    if edit.Title != nil {
+      metadata.Title = strings.TrimSpace(*edit.Title)
+    }
+    if edit.Description != nil {
+      metadata.Description = *edit.Description
+    }
+    if edit.DateTaken != nil {
+      metadata.DateTaken = *edit.DateTaken
+    }
+    if edit.Tags != nil {
+      metadata.Tags = *edit.Tags
     }
+    if edit.People != nil {
+      metadata.People = *edit.People
+    }
+    return nil
+  })
+  if err != nil {
+    fmt.Printf("Could not update %s: %v\n", basename, err)
+    http.Error(w, "Could not update video", 500)
+    return
+  }
 
-    // Check if we are done
-    expectedCount, _ := strconv.ParseInt(
-        r.FormValue("resumableTotalChunks"), 10, 32)
-    filename := r.FormValue("resumableFilename")
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(VideoJson{
+    VideoMetadata: metadata,
+    Urls: lib.getVideoUrls(basename),
+  })
+}
 
-    // NOTE: Need to write the file and check if we are done in a mutex
-    uploadMutex.Lock()
-    err = ioutil.WriteFile(filePath, data, 0744)
-    fileInfos, _ := ioutil.ReadDir(folderPath)
-    uploadMutex.Unlock()
+// UploadResult is the response to the last chunk of an upload.  When the
+// same file is already in the library, Duplicate is set, VideoId is the
+// existing video and nothing new is made.
+type UploadResult struct {
+  VideoId string
+  Duplicate bool
+}
 
+// uploadComplete assembles the chunks of an upload and hands it to
+// ingestFile.
+func uploadComplete(lib *Library, session *UploadSession,
+    force bool) (UploadResult, error) {
+  outputPath := session.folderPath() + "/assembled" +
+      uploadExt(session.Filename)
+  output, err := os.Create(outputPath)
+  if err != nil {
+    return UploadResult{}, err
+  }
+  sha256Hash := sha256.New()
+  writer := io.MultiWriter(output, sha256Hash)
+  for i := 1; i <= session.TotalChunks; i++ {
+    chunk, err := os.Open(session.chunkPath(i))
+    if err == nil {
+      _, err = io.Copy(writer, chunk)
+      chunk.Close()
+    }
     if err != nil {
-      fmt.Printf("Uh oh: %v", err);
-      http.Error(w, "Could not create file", 500)
-      return
+      output.Close()
+      return UploadResult{}, fmt.Errorf("Could not assemble chunk %d: %v",
+          i, err)
     }
+    os.Remove(session.chunkPath(i))
+  }
+  err = output.Close()
+  if err != nil {
+    return UploadResult{}, err
+  }
+  sum := hex.EncodeToString(sha256Hash.Sum(nil))
+  fmt.Printf("Complete file: %s (sha256 %s)\n", outputPath, sum)
+  return ingestFile(lib, outputPath, session.Filename, sum, force)
+}
 
+// A KeyedMutex is a set of mutexes named by strings, which only exist while
+// they are held or waited for.
+type KeyedMutex struct {
+  mutex sync.Mutex
+  locks map[string]*keyedLock
+}
 
-    if int(expectedCount) == len(fileInfos) {
-      uploadComplete(w, folderPath, filename, fileInfos)
-    }
-    fmt.Fprintf(w, "Saved")
-  } else {
-    http.Error(w, "Unsupported", 505)
+type keyedLock struct {
+  sync.Mutex
+  users int
+}
+
+func NewKeyedMutex() *KeyedMutex {
+  return &KeyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+func (m *KeyedMutex) Lock(key string) {
+  m.mutex.Lock()
+  lock, ok := m.locks[key]
+  if !ok {
+    lock = &keyedLock{}
+    m.locks[key] = lock
   }
+  lock.users++
+  m.mutex.Unlock()
+  lock.Lock()
 }
 
-func uploadComplete(w http.ResponseWriter, folderPath string, 
-    filename string, fileInfos []os.FileInfo) {
-  outputPath := fmt.Sprintf("/tmp/%s", filename)
-  output, _ := os.Create(outputPath)
-  for _, fileInfo := range fileInfos {
-    chunkData, err := ioutil.ReadFile(
-        fmt.Sprintf("%s/%s", folderPath, fileInfo.Name()))
-    if err != nil {
-      fmt.Printf("Error reading chunk: %v", err)
-    }
-    output.Write(chunkData)
+func (m *KeyedMutex) Unlock(key string) {
+  m.mutex.Lock()
+  lock := m.locks[key]
+  lock.users--
+  if lock.users == 0 {
+    delete(m.locks, key)
+  }
+  m.mutex.Unlock()
+  lock.Unlock()
+}
+
+// ingestFile starts processing the uploaded file at outputPath, whose
+// SHA-256 is sum, unless it duplicates a video already in lib and force
+// isn't set.  The file is moved away for the transcode job to use.
+func ingestFile(lib *Library, outputPath string, filename string,
+    sum string, force bool) (UploadResult, error) {
+  // NOTE: Ingests of the same file into a library run one at a time, so
+  //       two uploads of it can't both miss each other
+  lockKey := lib.Name + "/" + sum
+  ingestLocks.Lock(lockKey)
+  defer ingestLocks.Unlock(lockKey)
+
+  if existing, ok := lib.index.FindSha256(sum); ok && !force {
+    fmt.Printf("%s is a duplicate of %s\n", filename, existing.Id)
+    return UploadResult{VideoId: existing.Id, Duplicate: true}, nil
   }
-  fmt.Printf("Complete file: %s\n", outputPath)
-  os.RemoveAll(folderPath)
 
   // ffprobe some metadata out
   cmd := exec.Command("ffprobe",
@@ -313,31 +819,25 @@ func uploadComplete(w http.ResponseWriter, folderPath string,
   }
   cmd.Wait()
 
+  sourceWidth := width
+  sourceHeight := height
   if degrees == "90" || degrees == "270" {
     temp := width
     width = height
     height = temp
   }
+  _, _, dims640 := getDimensions(width, height)
 
-  var dims1920, dims1280, dims640 string
-  if width > height {
-    dims1920 = fmt.Sprintf("1920x%d", 1920 * height / width / 2 * 2)
-    dims1280 = fmt.Sprintf("1280x%d", 1280 * height / width / 2 * 2)
-    dims640 = fmt.Sprintf("640x%d", 640 * height / width / 2 * 2)
-  } else {
-    dims1920 = fmt.Sprintf("%dx1920", 1920 * width / height / 2 * 2)
-    dims1280 = fmt.Sprintf("%dx1280", 1280 * width / height / 2 * 2)
-    dims640 = fmt.Sprintf("%dx640", 640 * width / height / 2 * 2)
-  }
-
-  originalBaseName := path.Base(outputPath)
+  originalBaseName := filename
+  // NOTE: Uploads are ingested side by side, so the name and time alone
+  //       don't make the basename unique
   md5Hash := md5.New()
-  io.WriteString(md5Hash, fmt.Sprintf("%s|%d", originalBaseName, 
-      time.Now().Unix()))
+  io.WriteString(md5Hash, fmt.Sprintf("%s|%d|%s", originalBaseName, 
+      time.Now().Unix(), newId()))
   basename := fmt.Sprintf("%d_%x", dateTaken, md5Hash.Sum([]byte{}))
 
   // Create a thumbnail
-  thumbPath := "/tmp/" + basename + "_thumb.jpg"
+  thumbPath := workPath(basename + "_thumb.jpg")
   cmd = exec.Command("ffmpeg",
     "-i", outputPath,
     "-vframes", "1",
@@ -347,11 +847,10 @@ func uploadComplete(w http.ResponseWriter, folderPath string,
   )
   err = cmd.Run();
   if err != nil {
-    fmt.Printf("Could not generate thumbnail: %v\n", err)
-    return
+    return UploadResult{}, fmt.Errorf("Could not generate thumbnail: %v", err)
   }
   fmt.Printf("Thumbnail complete: %s\n", thumbPath)
-  uploadVideoFile(thumbPath, basename)
+  lib.uploadVideoFile(thumbPath, basename)
 
   metadata := VideoMetadata{
     Title: originalBaseName,
@@ -362,102 +861,264 @@ func uploadComplete(w http.ResponseWriter, folderPath string,
     DateTaken: dateTaken,
     DateUploaded: time.Now().Unix(),
     Status: "Processing",
+    Sha256: sum,
+    Width: sourceWidth,
+    Height: sourceHeight,
+    SourceRotation: degrees,
+  }
+  err = lib.putMetadata(basename, metadata)
+  if err != nil {
+    return UploadResult{}, err
   }
-  jsonMetadata, _ := json.Marshal(metadata)
-
-  _ = getS3Bucket().Put("/" + basename + "/metadata.json", 
-    []byte(jsonMetadata), "text/json", s3.PublicRead)
   fmt.Printf("Metadata written\n")
 
-  // NOTE: Do video transcodes in a goroutine
-  go func() {
-    video1080Path := "/tmp/" + basename + "_1080.mp4"
-    video720Path := "/tmp/" + basename + "_720.mp4"
-    video360Path := "/tmp/" + basename + "_360.mp4"
-    cmd := exec.Command("ffmpeg", 
-        "-i", outputPath,
-        "-y",
-        "-vf", getRotationVideoFilters(degrees),
-        "-metadata:s:v:0", "rotate=0",
-        "-s", dims1920,
-        "-vcodec", "libx264",
-        "-acodec", "libfaac",
-        video1080Path,
-
-        "-y",
-        "-vf", getRotationVideoFilters(degrees),
-        "-metadata:s:v:0", "rotate=0",
-        "-s", dims1280,
-        "-vcodec", "libx264",
-        "-acodec", "libfaac",
-        video720Path,
-
-        "-y",
-        "-vf", getRotationVideoFilters(degrees),
-        "-metadata:s:v:0", "rotate=0",
-        "-s", dims640,
-        "-vcodec", "libx264",
-        "-acodec", "libfaac",
-        video360Path,
-    )
-    // HACK: Only allow a single ffmpeg transcode to run at a time.  Should
-    //       really use some kind of queueing system (which would also)
-    //       allow recovery, but this works for now
-    ffmpegMutex.Lock()
-    cmd.Stdout = os.Stdout
-    cmd.Stderr = os.Stderr
-    err := cmd.Run()
-    ffmpegMutex.Unlock()
+  // NOTE: The transcode job owns the source file from here on, so give it a
+  //       name that can't collide with another upload of the same file
+  sourcePath := workPath(basename + "_source" + path.Ext(outputPath))
+  err = os.Rename(outputPath, sourcePath)
+  if err != nil {
+    return UploadResult{}, fmt.Errorf("Could not move source file: %v", err)
+  }
+  err = jobQueue.Enqueue(&Job{
+    Type: "transcode",
+    Library: lib.Name,
+    VideoId: basename,
+    Priority: PriorityLow,
+    SourcePath: sourcePath,
+    Degrees: degrees,
+    Width: width,
+    Height: height,
+    Duration: duration,
+  })
+  if err != nil {
+    fmt.Printf("Could not queue transcode: %v\n", err)
+  }
+  return UploadResult{VideoId: basename}, nil
+}
+
+// getDimensions returns ffmpeg sizes for the 1080, 720 and 360 renditions of
+// a width x height video, preserving its aspect ratio.
+func getDimensions(width int, height int) (string, string, string) {
+  var dims1920, dims1280, dims640 string
+  if width > height {
+    dims1920 = fmt.Sprintf("1920x%d", 1920 * height / width / 2 * 2)
+    dims1280 = fmt.Sprintf("1280x%d", 1280 * height / width / 2 * 2)
+    dims640 = fmt.Sprintf("640x%d", 640 * height / width / 2 * 2)
+  } else {
+    dims1920 = fmt.Sprintf("%dx1920", 1920 * width / height / 2 * 2)
+    dims1280 = fmt.Sprintf("%dx1280", 1280 * width / height / 2 * 2)
+    dims640 = fmt.Sprintf("%dx640", 640 * width / height / 2 * 2)
+  }
+  return dims1920, dims1280, dims640
+}
+
+// renderRotation returns how far to rotate the original when rendering, and
+// the width and height it will have afterwards.
+func (metadata VideoMetadata) renderRotation() (string, int, int) {
+  degrees := metadata.Rotation
+  if !metadata.IgnoreRotateTag {
+    sourceDegrees, _ := strconv.Atoi(metadata.SourceRotation)
+    degrees += sourceDegrees
+  }
+  degrees = (degrees % 360 + 360) % 360
+  width, height := metadata.Width, metadata.Height
+  if degrees == 90 || degrees == 270 {
+    width, height = height, width
+  }
+  return strconv.Itoa(degrees), width, height
+}
+
+// runTranscodeJob makes the renditions of a video.  New uploads are read
+// from job.SourcePath, which is then kept as the original.  Without a
+// SourcePath the video is being reprocessed, so the renditions and
+// thumbnail are remade from the stored original.
+func runTranscodeJob(lib *Library, job *Job) error {
+  basename := job.VideoId
+  sourcePath := job.SourcePath
+  if sourcePath == "" {
+    metadata, err := lib.getMetadata(basename)
     if err != nil {
-      fmt.Printf("Could not transcode file: %v\n", err)
-      return
+      return err
+    }
+    if metadata.Original == "" {
+      return fmt.Errorf("No original kept for %s", basename)
+    }
+    sourcePath = workPath(basename + "_original" +
+        path.Ext(metadata.Original))
+    err = downloadFile(lib.storage, metadata.Original, sourcePath)
+    if err != nil {
+      return err
+    }
+    defer os.RemoveAll(sourcePath)
+  }
+
+  dims1920, dims1280, dims640 := getDimensions(job.Width, job.Height)
+  video1080Path := workPath(basename + "_1080.mp4")
+  video720Path := workPath(basename + "_720.mp4")
+  video360Path := workPath(basename + "_360.mp4")
+  err := jobQueue.runFfmpeg(job, 0, 1,
+      "-i", sourcePath,
+      "-y",
+      "-vf", getRotationVideoFilters(job.Degrees),
+      "-metadata:s:v:0", "rotate=0",
+      "-s", dims1920,
+      "-vcodec", "libx264",
+      "-acodec", "libfaac",
+      video1080Path,
+
+      "-y",
+      "-vf", getRotationVideoFilters(job.Degrees),
+      "-metadata:s:v:0", "rotate=0",
+      "-s", dims1280,
+      "-vcodec", "libx264",
+      "-acodec", "libfaac",
+      video720Path,
+
+      "-y",
+      "-vf", getRotationVideoFilters(job.Degrees),
+      "-metadata:s:v:0", "rotate=0",
+      "-s", dims640,
+      "-vcodec", "libx264",
+      "-acodec", "libfaac",
+      video360Path,
+  )
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Transcode complete\n")
+
+  for _, videoPath := range [...]string{ video360Path,
+      video720Path, video1080Path } {
+    err = lib.uploadVideoFile(videoPath, basename)
+    if err != nil {
+      return err
     }
-    os.RemoveAll(outputPath)
-    fmt.Printf("Transcode complete\n")
+  }
 
-    for _, videoPath := range [...]string{ video360Path,
-        video720Path, video1080Path } {
-      uploadVideoFile(videoPath, basename)
+  original := ""
+  if job.SourcePath == "" {
+    thumbPath := workPath(basename + "_thumb.jpg")
+    err = exec.Command("ffmpeg",
+      "-i", sourcePath,
+      "-y",
+      "-vframes", "1",
+      "-vf", getRotationVideoFilters(job.Degrees),
+      "-s", dims640,
+      thumbPath,
+    ).Run()
+    if err != nil {
+      return fmt.Errorf("Could not generate thumbnail: %v", err)
     }
+    err = lib.uploadVideoFile(thumbPath, basename)
+    if err != nil {
+      return err
+    }
+  } else {
+    original = originalKey(basename, path.Ext(job.SourcePath))
+    err = lib.uploadOriginal(job.SourcePath, original)
+    if err != nil {
+      return err
+    }
+    os.RemoveAll(job.SourcePath)
+  }
 
+  _, err = lib.updateMetadata(basename, func(metadata *VideoMetadata) error {
     metadata.Status = "Ready"
-    jsonMetadata, _ := json.Marshal(metadata)
-    _ = getS3Bucket().Put("/" + basename + "/metadata.json", 
-        []byte(jsonMetadata), "text/json", s3.PublicRead)
-    fmt.Printf("Final metadata written\n")
-  }()
+    metadata.Error = ""
+    metadata.ErrorDetail = ""
+    metadata.DateFailed = 0
+    if original != "" {
+      metadata.Original = original
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Final metadata written\n")
+  return nil
 }
 
-func uploadVideoFile(filePath string, basename string) {
-  stat, _ := os.Stat(filePath)
-  uploadFilename := strings.Replace(filePath, "/tmp", basename, -1)
-  reader, _ := os.Open(filePath)
+// uploadOriginal stores the uploaded file at filePath as key, in the
+// configured storage class.
+func (lib *Library) uploadOriginal(filePath string, key string) error {
+  contentType := mime.TypeByExtension(path.Ext(filePath))
+  if contentType == "" {
+    contentType = "application/octet-stream"
+  }
+  err := putFile(lib.storage, key, filePath, contentType,
+      config.OriginalStorageClass)
+  if err != nil {
+    fmt.Printf("Failed to upload original %s: %v\n", filePath, err)
+    return err
+  }
+  fmt.Printf("Upload of original %s complete\n", key)
+  return nil
+}
+
+// putFile stores the local file at filePath as key, sending it in parts
+// once it is bigger than config.MultipartThresholdMB.
+func putFile(store Storage, key string, filePath string, contentType string,
+    class string) error {
+  file, err := os.Open(filePath)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  stat, err := file.Stat()
+  if err != nil {
+    return err
+  }
+  if stat.Size() > int64(config.MultipartThresholdMB) << 20 {
+    return store.PutMultipart(key, file, stat.Size(), contentType, class)
+  }
+  return store.PutReaderClass(key, file, stat.Size(), contentType, class)
+}
+
+func (lib *Library) uploadVideoFile(filePath string, basename string) error {
+  uploadFilename := basename + "/" + path.Base(filePath)
   var contentType string
   if (path.Ext(filePath) == ".jpg") {
     contentType = "image/jpg"
   } else { 
     contentType = "video/mp4"
   }
-  err := getS3Bucket().PutReader(uploadFilename, reader, stat.Size(),
-      contentType, s3.PublicRead)
+  err := putFile(lib.storage, uploadFilename, filePath, contentType, "")
   if err != nil {
     fmt.Printf("Failed to upload %s: %v\n", filePath, err)
   } else {
     fmt.Printf("Upload of %s complete\n", uploadFilename)
     os.RemoveAll(filePath)
   }
+  return err
 }
 
+// deleteVideo moves a video to the trash.  It is only removed from storage
+// once it has been there for config.TrashRetentionDays.
 func deleteVideo(w http.ResponseWriter, r *http.Request) {
   vars := mux.Vars(r)
   basename := vars["id"]
-  s3Bucket := getS3Bucket()
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  if _, ok := lib.index.Get(basename); !ok {
+    http.Error(w, "Not Found", 404)
+    return
+  }
 
-  s3Bucket.Del(fmt.Sprintf("%s/%s_1080.mp4", basename, basename))
-  s3Bucket.Del(fmt.Sprintf("%s/%s_720.mp4", basename, basename))
-  s3Bucket.Del(fmt.Sprintf("%s/%s_360.mp4", basename, basename))
-  s3Bucket.Del(fmt.Sprintf("%s/%s_thumb.jpg", basename, basename))
-  s3Bucket.Del(fmt.Sprintf("%s/metadata.json", basename))
+  _, err := lib.updateMetadata(basename, func(metadata *VideoMetadata) error {
+    if metadata.DateDeleted == 0 {
+      metadata.DateDeleted = time.Now().Unix()
+    }
+    return nil
+  })
+  if err != nil {
+    fmt.Printf("Could not delete %s: %v\n", basename, err)
+    http.Error(w, "Could not delete video", 500)
+    return
+  }
+  fmt.Printf("Moved %s to the trash\n", basename)
   fmt.Fprintf(w, "Deleted")
 }
 
@@ -478,145 +1139,293 @@ func rotate(w http.ResponseWriter, r *http.Request) {
   vars := mux.Vars(r)
   basename := vars["id"]
   degrees := vars["degrees"]
-  videoFilters := "transpose=4"
-  if degrees == "90" {
-    videoFilters = "transpose=1"
-  } else if degrees == "180" {
-    videoFilters = "transpose=2,transpose=2"
-  } else if degrees == "270" {
-    videoFilters = "transpose=2"
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  if degrees != "90" && degrees != "180" && degrees != "270" {
+    http.Error(w, "Degrees must be 90, 180 or 270", 400)
+    return
+  }
+  metadata, ok := lib.index.Get(basename)
+  if !ok {
+    http.Error(w, "Not Found", 404)
+    return
   }
 
   fmt.Printf("Rotating %s by %s degrees\n", basename, degrees)
 
-  // Create a thumbnail
-  thumbPath := "/tmp/" + basename + "_thumb.jpg"
-  cmd := exec.Command("ffmpeg",
-    "-i", fmt.Sprintf("http://s3.amazonaws.com/%s/%s/%s_360.mp4",
-        config.BucketName,
-        basename,
-        basename,
-        ),
+  if metadata.Original != "" {
+    err := lib.reprocess(basename, func(metadata *VideoMetadata) {
+      extra, _ := strconv.Atoi(degrees)
+      metadata.Rotation = (metadata.Rotation + extra) % 360
+    })
+    if err != nil {
+      http.Error(w, "Could not queue rotation", 500)
+      return
+    }
+    fmt.Fprintf(w, "Rotating");
+    return
+  }
+
+  // NOTE: Without an original, the renditions themselves are rotated
+  // Set the Status to Processing until the job finishes
+  metadata, _ = lib.setStatus(basename, "Processing")
+  fmt.Printf("Processing metadata written\n")
+
+  // NOTE: The thumbnail is cut from the current 360 rendition, so it has to
+  //       be queued ahead of the rotation itself
+  err := jobQueue.Enqueue(&Job{
+    Type: "thumbnail",
+    Library: lib.Name,
+    VideoId: basename,
+    Priority: PriorityHigh,
+    Degrees: degrees,
+  })
+  if err == nil {
+    err = jobQueue.Enqueue(&Job{
+      Type: "rotate",
+      Library: lib.Name,
+      VideoId: basename,
+      Priority: PriorityNormal,
+      Degrees: degrees,
+      Duration: metadata.Duration,
+    })
+  }
+  if err != nil {
+    http.Error(w, "Could not queue rotation", 500)
+    return
+  }
+
+  fmt.Fprintf(w, "Rotating");
+}
+
+func runThumbnailJob(lib *Library, job *Job) error {
+  basename := job.VideoId
+  thumbPath := workPath(basename + "_thumb.jpg")
+  inputPath := workPath(basename + "_360_input.mp4")
+  err := downloadFile(lib.storage, renditionKey(basename, "360"),
+      inputPath)
+  if err != nil {
+    return err
+  }
+  defer os.RemoveAll(inputPath)
+
+  err = jobQueue.runFfmpeg(job, 0, 1,
+    "-i", inputPath,
+    "-y",
     "-vframes", "1",
-    "-vf", getRotationVideoFilters(degrees),
+    "-vf", getRotationVideoFilters(job.Degrees),
     thumbPath,
   )
-  err := cmd.Run();
   if err != nil {
-    fmt.Printf("Could not generate thumbnail: %v\n", err)
-    return
+    return err
   }
   fmt.Printf("Thumbnail complete: %s\n", thumbPath)
-  uploadVideoFile(thumbPath, basename)  
-  
-  // Get the existing metadata and set the Status to Processing
-  s3Bucket := getS3Bucket()
-  data, _ := s3Bucket.Get(basename + "/metadata.json")
-  var metadata VideoMetadata
-  json.Unmarshal(data, &metadata)
-  metadata.Status = "Processing"
-  jsonMetadata, _ := json.Marshal(metadata)
-  _ = getS3Bucket().Put("/" + basename + "/metadata.json",
-      []byte(jsonMetadata), "text/json", s3.PublicRead)
-  fmt.Printf("Processing metadata written\n")
+  return lib.uploadVideoFile(thumbPath, basename)
+}
 
-  fmt.Fprintf(w, "Rotating");
+// rerenderSizes remakes each of the video's renditions that job hasn't
+// already replaced, running ffmpeg with the args ffmpegArgs returns for
+// it.  Every size is rendered before any is uploaded, and each is recorded
+// in job.DoneSizes once uploaded, so a retry or a resume after a restart
+// never applies the change to a rendition twice.
+func rerenderSizes(lib *Library, job *Job,
+    ffmpegArgs func(inputPath string, videoPath string) []string) error {
+  basename := job.VideoId
+  var sizes, videoPaths []string
+  for _, size := range [...]string{"1080", "720", "360"} {
+    if !job.sizeDone(size) {
+      sizes = append(sizes, size)
+    }
+  }
+  defer func() {
+    for _, videoPath := range videoPaths {
+      os.RemoveAll(videoPath)
+    }
+  }()
 
-  // NOTE: Do video rotations in a goroutine
-  go func() {
-    for _, size := range [...]string{"1080", "720", "360"} {
-      videoPath := "/tmp/" + basename + "_" + size + ".mp4"
-      cmd := exec.Command("ffmpeg", 
-          "-i", fmt.Sprintf("http://s3.amazonaws.com/%s/%s/%s_%s.mp4",
-              config.BucketName,
-              basename,
-              basename, 
-              size,
-              ),
-          "-y",
-          "-vf", videoFilters,
-          "-metadata:s:v:0", "rotate=0",
-          "-vcodec", "libx264",
-          "-acodec", "copy",
-          videoPath,
-      )
-      ffmpegMutex.Lock()
-      cmd.Stdout = os.Stdout
-      cmd.Stderr = os.Stderr
-      err := cmd.Run()
-      ffmpegMutex.Unlock()
-      if err != nil {
-        fmt.Printf("Could not transcode file: %v\n", err)
-        return
-      }
+  for i, size := range sizes {
+    videoPath := workPath(basename + "_" + size + ".mp4")
+    inputPath := workPath(basename + "_" + size + "_input.mp4")
+    err := downloadFile(lib.storage, renditionKey(basename, size),
+        inputPath)
+    if err != nil {
+      return err
+    }
+    videoPaths = append(videoPaths, videoPath)
+    err = jobQueue.runFfmpeg(job, i, len(sizes),
+        ffmpegArgs(inputPath, videoPath)...)
+    os.RemoveAll(inputPath)
+    if err != nil {
+      return err
+    }
+  }
 
-      uploadVideoFile(videoPath, basename)
-      os.RemoveAll(videoPath)
-      fmt.Printf("Rotate %s complete\n", size)
+  for i, size := range sizes {
+    err := lib.uploadVideoFile(videoPaths[i], basename)
+    if err == nil {
+      err = jobQueue.finishSize(job, size)
+    }
+    if err != nil {
+      return err
     }
+    fmt.Printf("Rotate %s complete\n", size)
+  }
 
-    metadata.Status = "Ready"
-    jsonMetadata, _ = json.Marshal(metadata)
-    _ = getS3Bucket().Put("/" + basename + "/metadata.json", 
-        []byte(jsonMetadata), "text/json", s3.PublicRead)
-    fmt.Printf("Final metadata written\n")
-  }()
+  _, err := lib.setStatus(basename, "Ready")
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Final metadata written\n")
+  return nil
+}
+
+func runRotateJob(lib *Library, job *Job) error {
+  return rerenderSizes(lib, job, func(inputPath string,
+      videoPath string) []string {
+    return []string{
+      "-i", inputPath,
+      "-y",
+      "-vf", getRotationVideoFilters(job.Degrees),
+      "-metadata:s:v:0", "rotate=0",
+      "-vcodec", "libx264",
+      "-acodec", "copy",
+      videoPath,
+    }
+  })
 }
 
 func stripRotateTag(w http.ResponseWriter, r *http.Request) {
   vars := mux.Vars(r)
   basename := vars["id"]
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  metadata, ok := lib.index.Get(basename)
+  if !ok {
+    http.Error(w, "Not Found", 404)
+    return
+  }
 
-  // Get the existing metadata and set the Status to Processing
-  s3Bucket := getS3Bucket()
-  data, _ := s3Bucket.Get(basename + "/metadata.json")
-  var metadata VideoMetadata
-  json.Unmarshal(data, &metadata)
-  metadata.Status = "Processing"
-  jsonMetadata, _ := json.Marshal(metadata)
-  _ = getS3Bucket().Put("/" + basename + "/metadata.json",
-      []byte(jsonMetadata), "text/json", s3.PublicRead)
+  if metadata.Original != "" {
+    err := lib.reprocess(basename, func(metadata *VideoMetadata) {
+      metadata.IgnoreRotateTag = true
+    })
+    if err != nil {
+      http.Error(w, "Could not queue rotate tag strip", 500)
+      return
+    }
+    fmt.Fprintf(w, "Stripping rotate tag");
+    return
+  }
+
+  // Set the Status to Processing until the job finishes
+  metadata, _ = lib.setStatus(basename, "Processing")
   fmt.Printf("Processing metadata written\n")
 
+  err := jobQueue.Enqueue(&Job{
+    Type: "stripRotateTag",
+    Library: lib.Name,
+    VideoId: basename,
+    Priority: PriorityHigh,
+    Duration: metadata.Duration,
+  })
+  if err != nil {
+    http.Error(w, "Could not queue rotate tag strip", 500)
+    return
+  }
+
   fmt.Fprintf(w, "Stripping rotate tag");
+}
 
-  go func() {
-    for _, size := range [...]string{"1080", "720", "360"} {
-      videoPath := "/tmp/" + basename + "_" + size + ".mp4"
-      cmd := exec.Command("ffmpeg", 
-          "-i", fmt.Sprintf("http://s3.amazonaws.com/%s/%s/%s_%s.mp4",
-              config.BucketName,
-              basename,
-              basename, 
-              size,
-              ),
-          "-y",
-          "-metadata:s:v:0", "rotate=0",
-          "-vcodec", "copy",
-          "-acodec", "copy",
-          videoPath,
-      )
-      ffmpegMutex.Lock()
-      cmd.Stdout = os.Stdout
-      cmd.Stderr = os.Stderr
-      err := cmd.Run()
-      ffmpegMutex.Unlock()
-      if err != nil {
-        fmt.Printf("Could not transcode file: %v\n", err)
-        return
-      }
+func runStripRotateTagJob(lib *Library, job *Job) error {
+  return rerenderSizes(lib, job, func(inputPath string,
+      videoPath string) []string {
+    return []string{
+      "-i", inputPath,
+      "-y",
+      "-metadata:s:v:0", "rotate=0",
+      "-vcodec", "copy",
+      "-acodec", "copy",
+      videoPath,
+    }
+  })
+}
 
-      uploadVideoFile(videoPath, basename)
-      os.RemoveAll(videoPath)
-      fmt.Printf("Rotate %s complete\n", size)
+func jobs(w http.ResponseWriter, r *http.Request) {
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  state := r.URL.Query().Get("state")
+  list := []Job{}
+  for _, job := range jobQueue.List() {
+    if job.Library == lib.Name && (state == "" || job.State == state) {
+      list = append(list, job)
     }
+  }
 
-    metadata.Status = "Ready"
-    jsonMetadata, _ = json.Marshal(metadata)
-    _ = getS3Bucket().Put("/" + basename + "/metadata.json", 
-        []byte(jsonMetadata), "text/json", s3.PublicRead)
-    fmt.Printf("Final metadata written\n")
-  }()
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(list)
+}
+
+func videoJob(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  job, ok := jobQueue.ForVideo(lib.Name, vars["id"])
+  if !ok {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(job)
 }
 
+func retryVideo(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  basename := vars["id"]
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  previous, err := lib.getMetadata(basename)
+  if err != nil {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+
+  // NOTE: Mark the video Processing before the job is queued, so a quick job
+  //       can't finish first and have its Ready status overwritten
+  lib.setStatus(basename, "Processing")
+  _, err = jobQueue.Retry(lib.Name, basename)
+  if err != nil {
+    lib.updateMetadata(basename, func(metadata *VideoMetadata) error {
+      metadata.Status = previous.Status
+      metadata.Error = previous.Error
+      metadata.ErrorDetail = previous.ErrorDetail
+      metadata.DateFailed = previous.DateFailed
+      return nil
+    })
+  }
+  if err == ErrNoFailedJob {
+    http.Error(w, err.Error(), 404)
+    return
+  } else if err == ErrJobActive {
+    http.Error(w, err.Error(), 409)
+    return
+  } else if err == ErrSourceMissing {
+    http.Error(w, err.Error(), 410)
+    return
+  } else if err != nil {
+    http.Error(w, "Could not queue retry", 500)
+    return
+  }
 
+  fmt.Fprintf(w, "Retrying")
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+  "golang.org/x/crypto/bcrypt"
+)
+
+// Roles, from least to most trusted.  Viewers can watch, uploaders can
+// also upload and edit metadata, and admins can do anything.
+const (
+  RoleViewer = "viewer"
+  RoleUploader = "uploader"
+  RoleAdmin = "admin"
+)
+
+var roleRanks = map[string]int{
+  RoleViewer: 1,
+  RoleUploader: 2,
+  RoleAdmin: 3,
+}
+
+func validRole(role string) bool {
+  _, ok := roleRanks[role]
+  return ok
+}
+
+// A User can log in to the archive.  Users are kept in the users file named
+// in config.json, which only ever holds bcrypt hashes of passwords.
+type User struct {
+  Username string
+  PasswordHash string
+  Role string
+
+  // Library is the name of the library the user works in.  Users from
+  // before libraries existed are in the default library, "".
+  Library string
+}
+
+// Can returns true if the user's role is at least role.
+func (user User) Can(role string) bool {
+  return roleRanks[user.Role] >= roleRanks[role]
+}
+
+var ErrNoUser = errors.New("No such user")
+var ErrLastAdmin = errors.New("There must always be an admin")
+
+// UserStore is the set of users, loaded from and saved to a JSON file.
+type UserStore struct {
+  path string
+  mutex sync.RWMutex
+  users map[string]User
+}
+
+func LoadUserStore(path string) (*UserStore, error) {
+  store := &UserStore{path: path, users: make(map[string]User)}
+  data, err := ioutil.ReadFile(path)
+  if os.IsNotExist(err) {
+    return store, nil
+  } else if err != nil {
+    return nil, err
+  }
+  var list []User
+  err = json.Unmarshal(data, &list)
+  if err != nil {
+    return nil, fmt.Errorf("Could not parse %s: %v", path, err)
+  }
+  for _, user := range list {
+    // Users from before roles existed could do everything
+    if user.Role == "" {
+      user.Role = RoleAdmin
+    }
+    store.users[user.Username] = user
+  }
+  return store, nil
+}
+
+func (store *UserStore) Get(username string) (User, bool) {
+  store.mutex.RLock()
+  defer store.mutex.RUnlock()
+  user, ok := store.users[username]
+  return user, ok
+}
+
+func (store *UserStore) Len() int {
+  store.mutex.RLock()
+  defer store.mutex.RUnlock()
+  return len(store.users)
+}
+
+// List returns every user, sorted by name.
+func (store *UserStore) List() []User {
+  store.mutex.RLock()
+  defer store.mutex.RUnlock()
+  list := make([]User, 0, len(store.users))
+  for _, user := range store.users {
+    list = append(list, user)
+  }
+  sort.Sort(usersByName(list))
+  return list
+}
+
+func hashPassword(password string) (string, error) {
+  if len(password) < 8 {
+    return "", fmt.Errorf("Passwords must be at least 8 characters")
+  }
+  hash, err := bcrypt.GenerateFromPassword([]byte(password),
+      bcrypt.DefaultCost)
+  return string(hash), err
+}
+
+// defaultLibrary returns the library for a new user who wasn't given one:
+// the default library for the first user, so an archive from before
+// libraries existed stays theirs.  Otherwise it returns nil, giving them a
+// library of their own.
+func defaultLibrary() *string {
+  if users.Len() == 0 {
+    root := ""
+    return &root
+  }
+  return nil
+}
+
+// Update creates username if they don't exist, then changes their password
+// and role unless those are empty, and their library unless it's nil.  New
+// users need a password and role, and get a library of their own unless
+// one is given.
+func (store *UserStore) Update(username string, password string,
+    role string, library *string) (User, error) {
+  if !validName(username) {
+    return User{}, fmt.Errorf("Usernames must be 1 to 100 letters, " +
+        "numbers, or any of _.@-")
+  }
+  if role != "" && !validRole(role) {
+    return User{}, fmt.Errorf("Role must be viewer, uploader or admin")
+  }
+  if library != nil && *library != "" && !validName(*library) {
+    return User{}, fmt.Errorf("Library names must be 1 to 100 letters, " +
+        "numbers, or any of _.@-")
+  }
+  hash := ""
+  if password != "" {
+    var err error
+    hash, err = hashPassword(password)
+    if err != nil {
+      return User{}, err
+    }
+  }
+
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  user, exists := store.users[username]
+  if !exists && (hash == "" || role == "") {
+    return User{}, fmt.Errorf("New users need a password and role")
+  }
+  if exists && user.Role == RoleAdmin && role != "" && role != RoleAdmin &&
+      store.countAdmins() == 1 {
+    return User{}, ErrLastAdmin
+  }
+  if !exists {
+    user.Library = username
+  }
+  user.Username = username
+  if library != nil {
+    user.Library = *library
+  }
+  if hash != "" {
+    user.PasswordHash = hash
+  }
+  if role != "" {
+    user.Role = role
+  }
+  store.users[username] = user
+  return user, store.save()
+}
+
+// Delete removes username.  Their sessions stop working right away, since
+// each request looks its user up again.
+func (store *UserStore) Delete(username string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  user, ok := store.users[username]
+  if !ok {
+    return ErrNoUser
+  }
+  if user.Role == RoleAdmin && store.countAdmins() == 1 {
+    return ErrLastAdmin
+  }
+  delete(store.users, username)
+  return store.save()
+}
+
+// countAdmins returns how many users are admins.  Callers hold mutex.
+func (store *UserStore) countAdmins() int {
+  count := 0
+  for _, user := range store.users {
+    if user.Role == RoleAdmin {
+      count++
+    }
+  }
+  return count
+}
+
+// save writes the users file atomically.  Callers hold mutex.
+func (store *UserStore) save() error {
+  list := make([]User, 0, len(store.users))
+  for _, user := range store.users {
+    list = append(list, user)
+  }
+  sort.Sort(usersByName(list))
+  data, err := json.MarshalIndent(list, "", "  ")
+  if err != nil {
+    return err
+  }
+  temp, err := ioutil.TempFile(filepath.Dir(store.path), ".users-")
+  if err != nil {
+    return err
+  }
+  _, err = temp.Write(data)
+  closeErr := temp.Close()
+  if err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    err = os.Rename(temp.Name(), store.path)
+  }
+  if err != nil {
+    os.Remove(temp.Name())
+  }
+  return err
+}
+
+type usersByName []User
+
+func (s usersByName) Len() int { return len(s) }
+func (s usersByName) Less(i, j int) bool {
+  return s[i].Username < s[j].Username
+}
+func (s usersByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// dummyHash is compared against when a username doesn't exist, so a login
+// takes as long whether or not the user does.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"),
+    bcrypt.DefaultCost)
+
+// Authenticate returns the user if password is theirs.
+func (store *UserStore) Authenticate(username string,
+    password string) (User, bool) {
+  user, ok := store.Get(username)
+  hash := dummyHash
+  if ok {
+    hash = []byte(user.PasswordHash)
+  }
+  err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+  return user, ok && err == nil
+}
+
+// addUser implements the -adduser flag, reading the new password from
+// stdin so it doesn't end up in shell history.  Without a role, new users
+// are viewers, except the first who is an admin.
+func addUser(username string, role string, library *string) error {
+  if _, exists := users.Get(username); !exists && role == "" {
+    role = RoleViewer
+    if users.Len() == 0 {
+      role = RoleAdmin
+    }
+  }
+  if _, exists := users.Get(username); !exists && library == nil {
+    library = defaultLibrary()
+  }
+  fmt.Printf("Password for %s: ", username)
+  password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+  if err != nil && password == "" {
+    return err
+  }
+  password = strings.TrimRight(password, "\r\n")
+  if password == "" {
+    return fmt.Errorf("No password given")
+  }
+  user, err := users.Update(username, password, role, library)
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Saved %s (%s in library %q) to %s\n", username, user.Role,
+      user.Library, config.UsersFile)
+  return nil
+}
+
+const sessionCookieName = "va_session"
+const sessionDuration = 30 * 24 * time.Hour
+
+type Session struct {
+  Username string
+  Expires time.Time
+}
+
+// SessionStore holds logged in sessions in memory, so everyone has to log
+// in again when the server restarts.
+type SessionStore struct {
+  mutex sync.Mutex
+  sessions map[string]Session
+}
+
+func NewSessionStore() *SessionStore {
+  return &SessionStore{sessions: make(map[string]Session)}
+}
+
+func (store *SessionStore) Create(username string) (string, Session) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+
+  // Drop expired sessions while we're here
+  now := time.Now()
+  for id, session := range store.sessions {
+    if now.After(session.Expires) {
+      delete(store.sessions, id)
+    }
+  }
+
+  id := newId() + newId()
+  session := Session{Username: username, Expires: now.Add(sessionDuration)}
+  store.sessions[id] = session
+  return id, session
+}
+
+func (store *SessionStore) Get(id string) (Session, bool) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  session, ok := store.sessions[id]
+  if !ok || time.Now().After(session.Expires) {
+    return session, false
+  }
+  return session, true
+}
+
+func (store *SessionStore) Delete(id string) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  delete(store.sessions, id)
+}
+
+// currentUser returns the user r's session belongs to.
+func currentUser(r *http.Request) (User, bool) {
+  cookie, err := r.Cookie(sessionCookieName)
+  if err != nil {
+    return User{}, false
+  }
+  session, ok := sessions.Get(cookie.Value)
+  if !ok {
+    return User{}, false
+  }
+  return users.Get(session.Username)
+}
+
+// requireLogin wraps handler so only logged in users reach it.  Pages send
+// everyone else to the login form; API calls get a 401.
+func requireLogin(handler http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if _, ok := currentUser(r); ok {
+      handler(w, r)
+      return
+    }
+    if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"),
+        "text/html") {
+      next := url.QueryEscape(r.URL.RequestURI())
+      http.Redirect(w, r, "/login?next=" + next, 303)
+      return
+    }
+    http.Error(w, "Unauthorized", 401)
+  }
+}
+
+// requireRole wraps handler so only users with at least role reach it.
+func requireRole(role string, handler http.HandlerFunc) http.HandlerFunc {
+  return requireLogin(func(w http.ResponseWriter, r *http.Request) {
+    user, _ := currentUser(r)
+    if !user.Can(role) {
+      http.Error(w, "Forbidden", 403)
+      return
+    }
+    handler(w, r)
+  })
+}
+
+type LoginPage struct {
+  Next string
+  Username string
+  Failed bool
+}
+
+// safeNext only allows redirecting to paths on this server after login.
+func safeNext(next string) string {
+  if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") ||
+      strings.HasPrefix(next, "/\\") {
+    return "/"
+  }
+  return next
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+  page := LoginPage{Next: safeNext(r.FormValue("next"))}
+  if r.Method == "POST" {
+    page.Username = r.FormValue("username")
+    user, ok := users.Authenticate(page.Username, r.FormValue("password"))
+    if ok {
+      id, session := sessions.Create(user.Username)
+      http.SetCookie(w, &http.Cookie{
+        Name: sessionCookieName,
+        Value: id,
+        Path: "/",
+        Expires: session.Expires,
+        HttpOnly: true,
+        SameSite: http.SameSiteLaxMode,
+      })
+      fmt.Printf("%s logged in\n", user.Username)
+      http.Redirect(w, r, page.Next, 303)
+      return
+    }
+    fmt.Printf("Failed login for %q\n", page.Username)
+    page.Failed = true
+    w.WriteHeader(401)
+  }
+  templates.ExecuteTemplate(w, "login.html", page)
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+  cookie, err := r.Cookie(sessionCookieName)
+  if err == nil {
+    sessions.Delete(cookie.Value)
+  }
+  http.SetCookie(w, &http.Cookie{
+    Name: sessionCookieName,
+    Value: "",
+    Path: "/",
+    MaxAge: -1,
+  })
+  http.Redirect(w, r, "/login", 303)
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "mime"
+  "net/http"
+  "os"
+  "path"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "github.com/gorilla/mux"
+  "launchpad.net/goamz/s3"
+)
+
+// Direct uploads send a file from the browser straight to S3 as a multipart
+// upload, rather than through the server in resumable.js chunks.  The
+// server starts the upload and signs a URL for each part.  Once every part
+// is in, it completes the upload and queues an ingest job, which reads the
+// file back and processes it like any other upload.  The browser polls the
+// upload to find out how that went.
+
+// S3 needs every part but the last to be at least 5MB, and allows at most
+// 10,000 parts and 5TB.
+const (
+  defaultPartSize = 16 << 20
+  maxParts = 10000
+  maxDirectUploadSize = 5 << 40
+)
+
+const partUrlTtl = time.Hour
+
+// A DirectUpload is saved as uploads/<id>.json at the bucket root, next to
+// the object the parts are sent to.  Once the ingest job has processed the
+// object and deleted it, Result is set, and the janitor removes the record
+// a while later.
+type DirectUpload struct {
+  Id string
+  Username string
+  Library string
+  Filename string
+  Key string
+  UploadId string
+  Size int64
+  PartSize int64
+  Parts int
+  DateStarted int64
+  Completed bool
+  Result *UploadResult `json:",omitempty"`
+}
+
+// A DirectUploadRequest is the body of POST /upload/s3.
+type DirectUploadRequest struct {
+  Filename string
+  Size int64
+}
+
+// DirectUploadJson describes an upload to its owner.  State is one of the
+// upload session states: Uploading until the parts are complete, then
+// Completing while the ingest job runs, and finally Complete with a Result,
+// or Failed with the job's Error.
+type DirectUploadJson struct {
+  Id string
+  Filename string
+  PartSize int64
+  Parts int
+  Completed bool
+  State string
+  Result *UploadResult `json:",omitempty"`
+  Error string `json:",omitempty"`
+}
+
+// directUploadMutex keeps two requests from completing the same upload.
+var directUploadMutex sync.Mutex
+
+func directUploadKey(id string) string {
+  return "uploads/" + id + ".json"
+}
+
+// s3Bucket returns the bucket videos are stored in, or false if they aren't
+// stored on S3.
+func s3Bucket() (*s3.Bucket, bool) {
+  s3Storage, ok := storage.(*S3Storage)
+  if !ok {
+    return nil, false
+  }
+  return s3Storage.bucket, true
+}
+
+func getDirectUpload(id string) (DirectUpload, error) {
+  var upload DirectUpload
+  data, err := storage.Get(directUploadKey(id))
+  if err != nil {
+    return upload, err
+  }
+  err = json.Unmarshal(data, &upload)
+  return upload, err
+}
+
+func (upload DirectUpload) save() error {
+  data, _ := json.Marshal(upload)
+  return storage.Put(directUploadKey(upload.Id), data, "text/json")
+}
+
+func (upload DirectUpload) multi(bucket *s3.Bucket) *s3.Multi {
+  return &s3.Multi{Bucket: bucket, Key: upload.Key, UploadId: upload.UploadId}
+}
+
+func (upload DirectUpload) toJson() DirectUploadJson {
+  result := DirectUploadJson{
+    Id: upload.Id,
+    Filename: upload.Filename,
+    PartSize: upload.PartSize,
+    Parts: upload.Parts,
+    Completed: upload.Completed,
+    State: UploadUploading,
+    Result: upload.Result,
+  }
+  if upload.Result != nil {
+    result.State = UploadComplete
+  } else if upload.Completed {
+    result.State = UploadCompleting
+    job, ok := jobQueue.ForUpload(upload.Id)
+    if !ok {
+      result.State = UploadFailed
+      result.Error = "Processing was never queued"
+    } else if job.State == JobFailed {
+      result.State = UploadFailed
+      result.Error = job.LastError
+    }
+  }
+  return result
+}
+
+// partLength returns how many bytes part n must have.
+func (upload DirectUpload) partLength(n int) int64 {
+  if n < upload.Parts {
+    return upload.PartSize
+  }
+  return upload.Size - int64(upload.Parts - 1) * upload.PartSize
+}
+
+// partSizeFor returns the part size for a file of size bytes, growing it in
+// whole megabytes when the default would need too many parts.
+func partSizeFor(size int64) int64 {
+  partSize := int64(defaultPartSize)
+  if needed := (size + maxParts - 1) / maxParts; needed > partSize {
+    partSize = (needed + (1 << 20) - 1) >> 20 << 20
+  }
+  return partSize
+}
+
+// startDirectUpload begins a multipart upload for the file described in the
+// body.
+func startDirectUpload(w http.ResponseWriter, r *http.Request) {
+  bucket, ok := s3Bucket()
+  if !ok {
+    http.Error(w, "Direct uploads need S3 storage", 404)
+    return
+  }
+  user, _ := currentUser(r)
+  var req DirectUploadRequest
+  err := json.NewDecoder(io.LimitReader(r.Body, 64 * 1024)).Decode(&req)
+  if err != nil {
+    http.Error(w, "Invalid JSON body", 400)
+    return
+  }
+  filename, ok := cleanUploadFilename(req.Filename)
+  if !ok {
+    http.Error(w, "Invalid Filename", 400)
+    return
+  }
+  if req.Size <= 0 || req.Size > maxDirectUploadSize {
+    http.Error(w, "Size must be between 1 byte and 5TB", 400)
+    return
+  }
+
+  upload := DirectUpload{
+    Id: newId(),
+    Username: user.Username,
+    Library: user.Library,
+    Filename: filename,
+    Size: req.Size,
+    PartSize: partSizeFor(req.Size),
+    DateStarted: time.Now().Unix(),
+  }
+  upload.Parts = int((req.Size + upload.PartSize - 1) / upload.PartSize)
+  ext := uploadExt(filename)
+  upload.Key = "uploads/" + upload.Id + ext
+  contentType := mime.TypeByExtension(ext)
+  if contentType == "" {
+    contentType = "application/octet-stream"
+  }
+  multi, err := bucket.InitMulti(upload.Key, contentType, s3.Private)
+  if err != nil {
+    fmt.Printf("Could not start multipart upload: %v\n", err)
+    http.Error(w, "Could not start upload", 500)
+    return
+  }
+  upload.UploadId = multi.UploadId
+  err = upload.save()
+  if err != nil {
+    fmt.Printf("Could not save direct upload: %v\n", err)
+    multi.Abort()
+    http.Error(w, "Could not start upload", 500)
+    return
+  }
+  fmt.Printf("Started direct upload %s of %s in %d parts\n", upload.Id,
+      filename, upload.Parts)
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(201)
+  json.NewEncoder(w).Encode(upload.toJson())
+}
+
+// loadDirectUpload fetches the logged in user's upload named in the URL,
+// writing an error and returning false if there isn't one.
+func loadDirectUpload(w http.ResponseWriter, r *http.Request) (DirectUpload,
+    *s3.Bucket, bool) {
+  bucket, ok := s3Bucket()
+  if !ok {
+    http.Error(w, "Direct uploads need S3 storage", 404)
+    return DirectUpload{}, nil, false
+  }
+  user, _ := currentUser(r)
+  upload, err := getDirectUpload(mux.Vars(r)["id"])
+  if err != nil || upload.Username != user.Username {
+    http.Error(w, "Not Found", 404)
+    return upload, nil, false
+  }
+  return upload, bucket, true
+}
+
+// listDirectUploads lists the logged in user's direct uploads that are
+// unfinished, being processed, or failed, so the page can show them.
+func listDirectUploads(w http.ResponseWriter, r *http.Request) {
+  if _, ok := s3Bucket(); !ok {
+    http.Error(w, "Direct uploads need S3 storage", 404)
+    return
+  }
+  user, _ := currentUser(r)
+  keys, _, err := listAll(storage, "uploads/", "/")
+  if err != nil {
+    fmt.Printf("Could not list direct uploads: %v\n", err)
+    http.Error(w, "Could not list uploads", 500)
+    return
+  }
+  result := []DirectUploadJson{}
+  for _, key := range keys {
+    if path.Ext(key) != ".json" {
+      continue
+    }
+    upload, err := getDirectUpload(strings.TrimSuffix(path.Base(key),
+        ".json"))
+    if err != nil || upload.Username != user.Username ||
+        upload.Result != nil {
+      continue
+    }
+    result = append(result, upload.toJson())
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(result)
+}
+
+// directUploadStatus returns the upload named in the URL, which the page
+// polls to find out how processing went.
+func directUploadStatus(w http.ResponseWriter, r *http.Request) {
+  upload, _, ok := loadDirectUpload(w, r)
+  if !ok {
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(upload.toJson())
+}
+
+// retryDirectUpload queues the upload's failed ingest job again, or queues
+// one if it never was.
+func retryDirectUpload(w http.ResponseWriter, r *http.Request) {
+  upload, _, ok := loadDirectUpload(w, r)
+  if !ok {
+    return
+  }
+  if upload.toJson().State != UploadFailed {
+    http.Error(w, "Upload has not failed", 409)
+    return
+  }
+  var err error
+  if _, ok := jobQueue.ForUpload(upload.Id); ok {
+    _, err = jobQueue.RetryUpload(upload.Id)
+  } else {
+    err = jobQueue.Enqueue(&Job{
+      Type: "ingest",
+      Library: upload.Library,
+      Priority: PriorityNormal,
+      UploadId: upload.Id,
+    })
+  }
+  if err == ErrNoFailedJob {
+    http.Error(w, "Upload has not failed", 409)
+    return
+  } else if err == ErrJobActive {
+    http.Error(w, "Upload is already being processed", 409)
+    return
+  } else if err != nil {
+    http.Error(w, "Could not queue retry", 500)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(202)
+  json.NewEncoder(w).Encode(upload.toJson())
+}
+
+// directUploadPart returns a URL the browser can PUT part n to.
+func directUploadPart(w http.ResponseWriter, r *http.Request) {
+  upload, bucket, ok := loadDirectUpload(w, r)
+  if !ok {
+    return
+  }
+  n, err := strconv.Atoi(mux.Vars(r)["n"])
+  if err != nil || n < 1 || n > upload.Parts {
+    http.Error(w, "Part out of range", 400)
+    return
+  }
+  if upload.Completed {
+    http.Error(w, "Upload is already complete", 409)
+    return
+  }
+  url := upload.multi(bucket).SignedURL(n, time.Now().Add(partUrlTtl))
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(map[string]string{"Url": url})
+}
+
+// completeDirectUpload checks every part arrived whole, assembles them, and
+// queues the ingest job.  Set force=1 to keep a duplicate.  Poll the upload
+// to find out how processing went.
+func completeDirectUpload(w http.ResponseWriter, r *http.Request) {
+  upload, bucket, ok := loadDirectUpload(w, r)
+  if !ok {
+    return
+  }
+  directUploadMutex.Lock()
+  defer directUploadMutex.Unlock()
+  upload, err := getDirectUpload(upload.Id)
+  if err != nil {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+
+  if !upload.Completed {
+    multi := upload.multi(bucket)
+    parts, err := multi.ListParts()
+    if err != nil {
+      fmt.Printf("Could not list parts of %s: %v\n", upload.Id, err)
+      http.Error(w, "Could not list parts", 500)
+      return
+    }
+    if len(parts) != upload.Parts {
+      http.Error(w, fmt.Sprintf("Only %d of %d parts have arrived",
+          len(parts), upload.Parts), 409)
+      return
+    }
+    for i, part := range parts {
+      if part.N != i + 1 || part.Size != upload.partLength(part.N) {
+        http.Error(w, fmt.Sprintf("Part %d should be %d bytes, not %d",
+            part.N, upload.partLength(part.N), part.Size), 409)
+        return
+      }
+    }
+    err = multi.Complete(parts)
+    if err != nil {
+      fmt.Printf("Could not complete %s: %v\n", upload.Id, err)
+      http.Error(w, "Could not complete upload", 500)
+      return
+    }
+
+    upload.Completed = true
+    err = upload.save()
+    if err == nil {
+      err = jobQueue.Enqueue(&Job{
+        Type: "ingest",
+        Library: upload.Library,
+        Priority: PriorityNormal,
+        UploadId: upload.Id,
+        Force: r.FormValue("force") == "1",
+      })
+    }
+    if err != nil {
+      fmt.Printf("Could not queue ingest of %s: %v\n", upload.Id, err)
+      http.Error(w, "Could not queue processing", 500)
+      return
+    }
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(202)
+  json.NewEncoder(w).Encode(upload.toJson())
+}
+
+// abortDirectUpload throws away an upload that hasn't been completed.
+func abortDirectUpload(w http.ResponseWriter, r *http.Request) {
+  upload, bucket, ok := loadDirectUpload(w, r)
+  if !ok {
+    return
+  }
+  if upload.Completed {
+    http.Error(w, "Upload is already complete", 409)
+    return
+  }
+  err := upload.multi(bucket).Abort()
+  if err != nil {
+    fmt.Printf("Could not abort %s: %v\n", upload.Id, err)
+    http.Error(w, "Could not abort upload", 500)
+    return
+  }
+  storage.Delete(directUploadKey(upload.Id))
+  fmt.Fprintf(w, "Aborted")
+}
+
+// runIngestJob reads a completed direct upload back from S3 and processes
+// it, then deletes the object and records the result.
+func runIngestJob(lib *Library, job *Job) error {
+  upload, err := getDirectUpload(job.UploadId)
+  if err != nil {
+    return err
+  }
+  if upload.Result != nil {
+    return nil
+  }
+  reader, err := storage.GetReader(upload.Key)
+  if err != nil {
+    return err
+  }
+  defer reader.Close()
+
+  localPath := workPath("direct_" + upload.Id + uploadExt(upload.Filename))
+  file, err := os.Create(localPath)
+  if err != nil {
+    return err
+  }
+  defer os.Remove(localPath)
+  sha256Hash := sha256.New()
+  written, err := io.Copy(io.MultiWriter(file, sha256Hash), reader)
+  closeErr := file.Close()
+  if err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return err
+  }
+  if written != upload.Size {
+    return fmt.Errorf("Read %d bytes of %s, expected %d", written,
+        upload.Key, upload.Size)
+  }
+  sum := hex.EncodeToString(sha256Hash.Sum(nil))
+  fmt.Printf("Read back %s (sha256 %s)\n", upload.Key, sum)
+
+  result, err := ingestFile(lib, localPath, upload.Filename, sum, job.Force)
+  if err != nil {
+    return err
+  }
+  if result.Duplicate {
+    fmt.Printf("Direct upload %s was a duplicate of %s\n", upload.Id,
+        result.VideoId)
+  }
+
+  err = storage.Delete(upload.Key)
+  if err != nil {
+    fmt.Printf("Could not delete %s: %v\n", upload.Key, err)
+  }
+  upload.Result = &result
+  return upload.save()
+}
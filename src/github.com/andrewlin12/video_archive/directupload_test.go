@@ -0,0 +1,28 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestPartSizeFor(t *testing.T) {
+  const mb = 1 << 20
+  tests := []struct {
+    size int64
+    want int64
+  }{
+    {0, defaultPartSize},
+    {1, defaultPartSize},
+    {defaultPartSize * maxParts, defaultPartSize},
+    {defaultPartSize * maxParts + 1, 17 * mb},
+    {1 << 40, 105 * mb},
+  }
+  for _, test := range tests {
+    got := partSizeFor(test.size)
+    if got != test.want {
+      t.Errorf("partSizeFor(%d) = %d, want %d", test.size, got, test.want)
+    }
+    if parts := (test.size + got - 1) / got; parts > maxParts {
+      t.Errorf("partSizeFor(%d) needs %d parts", test.size, parts)
+    }
+  }
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+// VideoIndex holds the metadata for every video in a library, so listing
+// doesn't need a request per video.  It is kept in memory and saved to a
+// single manifest object in storage whenever a video's metadata changes.
+type VideoIndex struct {
+  storage Storage
+  key string
+  mutex sync.RWMutex
+  saveMutex sync.Mutex
+  videos map[string]VideoMetadata
+
+  // hashes maps the Sha256 of each upload to the videos made from it, so
+  // duplicates can be found without a scan.
+  hashes map[string][]string
+}
+
+// LoadVideoIndex reads the manifest at key in store, rebuilding it from the
+// per-video metadata.json files if it doesn't exist yet.
+func LoadVideoIndex(store Storage, key string, rebuild bool) (*VideoIndex,
+    error) {
+  idx := &VideoIndex{
+    storage: store,
+    key: key,
+    videos: make(map[string]VideoMetadata),
+    hashes: make(map[string][]string),
+  }
+
+  if !rebuild {
+    data, err := store.Get(key)
+    if err == nil {
+      err = json.Unmarshal(data, &idx.videos)
+      if err != nil {
+        return nil, fmt.Errorf("Could not parse %s: %v", key, err)
+      }
+      for basename, metadata := range idx.videos {
+        idx.addHash(basename, metadata)
+      }
+      fmt.Printf("Loaded index of %d videos\n", len(idx.videos))
+      return idx, nil
+    }
+    fmt.Printf("Could not read %s, rebuilding: %v\n", key, err)
+  }
+
+  err := idx.rebuild()
+  if err != nil {
+    return nil, err
+  }
+  return idx, nil
+}
+
+// nonVideoPrefixes are the top level folders of a library that don't hold
+// videos.
+var nonVideoPrefixes = map[string]bool{
+  "albums": true,
+  "libraries": true,
+  "shares": true,
+  "uploads": true,
+}
+
+func (idx *VideoIndex) rebuild() error {
+  _, prefixes, err := listAll(idx.storage, "", "/")
+  if err != nil {
+    return err
+  }
+  for _, prefix := range prefixes {
+    basename := strings.TrimSuffix(prefix, "/")
+    if nonVideoPrefixes[basename] {
+      continue
+    }
+    metadata, err := readMetadata(idx.storage, basename)
+    if err != nil {
+      fmt.Printf("Skipping %s: %v\n", basename, err)
+      continue
+    }
+    idx.videos[basename] = metadata
+    idx.addHash(basename, metadata)
+  }
+  fmt.Printf("Rebuilt index of %d videos\n", len(idx.videos))
+  return idx.save()
+}
+
+// Set records metadata for basename and saves the manifest.
+func (idx *VideoIndex) Set(basename string, metadata VideoMetadata) error {
+  idx.saveMutex.Lock()
+  defer idx.saveMutex.Unlock()
+
+  idx.mutex.Lock()
+  idx.removeHash(basename, idx.videos[basename])
+  idx.videos[basename] = metadata
+  idx.addHash(basename, metadata)
+  idx.mutex.Unlock()
+  return idx.save()
+}
+
+// Delete removes basename and saves the manifest.
+func (idx *VideoIndex) Delete(basename string) error {
+  idx.saveMutex.Lock()
+  defer idx.saveMutex.Unlock()
+
+  idx.mutex.Lock()
+  idx.removeHash(basename, idx.videos[basename])
+  delete(idx.videos, basename)
+  idx.mutex.Unlock()
+  return idx.save()
+}
+
+// save writes the manifest.  Callers hold saveMutex, so saves land in the
+// same order as the changes they capture.
+func (idx *VideoIndex) save() error {
+  idx.mutex.RLock()
+  data, err := json.Marshal(idx.videos)
+  idx.mutex.RUnlock()
+  if err != nil {
+    return err
+  }
+  return idx.storage.Put(idx.key, data, "text/json")
+}
+
+func (idx *VideoIndex) Get(basename string) (VideoMetadata, bool) {
+  idx.mutex.RLock()
+  defer idx.mutex.RUnlock()
+  metadata, ok := idx.videos[basename]
+  return metadata, ok
+}
+
+// addHash and removeHash keep hashes in step with videos.  Callers hold
+// mutex.
+func (idx *VideoIndex) addHash(basename string, metadata VideoMetadata) {
+  if metadata.Sha256 != "" {
+    idx.hashes[metadata.Sha256] = append(idx.hashes[metadata.Sha256],
+        basename)
+  }
+}
+
+func (idx *VideoIndex) removeHash(basename string, metadata VideoMetadata) {
+  ids := idx.hashes[metadata.Sha256]
+  for i, id := range ids {
+    if id == basename {
+      ids = append(ids[:i:i], ids[i + 1:]...)
+      break
+    }
+  }
+  if len(ids) == 0 {
+    delete(idx.hashes, metadata.Sha256)
+  } else {
+    idx.hashes[metadata.Sha256] = ids
+  }
+}
+
+// FindSha256 returns a video made from an upload with the given hash,
+// ignoring videos in the trash.
+func (idx *VideoIndex) FindSha256(sum string) (IndexedVideo, bool) {
+  idx.mutex.RLock()
+  defer idx.mutex.RUnlock()
+  for _, id := range idx.hashes[sum] {
+    metadata := idx.videos[id]
+    if metadata.DateDeleted == 0 {
+      return IndexedVideo{Id: id, Metadata: metadata}, true
+    }
+  }
+  return IndexedVideo{}, false
+}
+
+type IndexedVideo struct {
+  Id string
+  Metadata VideoMetadata
+}
+
+// SortKey orders videos by the date they were taken.  DateTaken can be
+// edited, so it can't be read from the basename.
+func (v IndexedVideo) SortKey() string {
+  return fmt.Sprintf("%012d_%s", v.Metadata.DateTaken, v.Id)
+}
+
+type videosByNewest []IndexedVideo
+
+func (s videosByNewest) Len() int { return len(s) }
+func (s videosByNewest) Less(i, j int) bool {
+  return s[i].SortKey() > s[j].SortKey()
+}
+func (s videosByNewest) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// List returns a snapshot of every video, newest first.
+func (idx *VideoIndex) List() []IndexedVideo {
+  idx.mutex.RLock()
+  list := make([]IndexedVideo, 0, len(idx.videos))
+  for id, metadata := range idx.videos {
+    list = append(list, IndexedVideo{Id: id, Metadata: metadata})
+  }
+  idx.mutex.RUnlock()
+
+  sort.Sort(videosByNewest(list))
+  return list
+}
+
+// A VideoFilter narrows down a listing.  Zero values match everything but
+// videos in the trash, which only match when Deleted is set.
+type VideoFilter struct {
+  Deleted bool
+  From int64
+  To int64
+  Query string
+  MinDuration float64
+  MaxDuration float64
+  Status string
+  Tag string
+  Person string
+}
+
+// parseVideoFilter reads a filter from query parameters: from and to bound
+// DateTaken (unix seconds, inclusive), q is a case-insensitive substring of
+// the title, description or original file name, minDuration and
+// maxDuration bound the length in seconds, status matches exactly, and tag
+// and person match a label on the video.
+func parseVideoFilter(qs url.Values) (VideoFilter, error) {
+  var filter VideoFilter
+  for _, name := range [...]string{"from", "to"} {
+    if qs.Get(name) == "" {
+      continue
+    }
+    value, err := strconv.ParseInt(qs.Get(name), 10, 64)
+    if err != nil {
+      return filter, fmt.Errorf("Invalid '%s' parameter", name)
+    }
+    if name == "from" {
+      filter.From = value
+    } else {
+      filter.To = value
+    }
+  }
+  for _, name := range [...]string{"minDuration", "maxDuration"} {
+    if qs.Get(name) == "" {
+      continue
+    }
+    value, err := strconv.ParseFloat(qs.Get(name), 64)
+    if err != nil {
+      return filter, fmt.Errorf("Invalid '%s' parameter", name)
+    }
+    if name == "minDuration" {
+      filter.MinDuration = value
+    } else {
+      filter.MaxDuration = value
+    }
+  }
+  filter.Query = strings.ToLower(strings.TrimSpace(qs.Get("q")))
+  filter.Status = qs.Get("status")
+  filter.Tag = normalizeLabel(qs.Get("tag"), true)
+  filter.Person = normalizeLabel(qs.Get("person"), false)
+  return filter, nil
+}
+
+func (filter VideoFilter) Matches(metadata VideoMetadata) bool {
+  if (metadata.DateDeleted != 0) != filter.Deleted {
+    return false
+  }
+  if filter.From != 0 && metadata.DateTaken < filter.From {
+    return false
+  }
+  if filter.To != 0 && metadata.DateTaken > filter.To {
+    return false
+  }
+  if filter.MinDuration != 0 && metadata.Duration < filter.MinDuration {
+    return false
+  }
+  if filter.MaxDuration != 0 && metadata.Duration > filter.MaxDuration {
+    return false
+  }
+  if filter.Status != "" && metadata.Status != filter.Status {
+    return false
+  }
+  if filter.Tag != "" && !hasLabel(metadata.Tags, filter.Tag) {
+    return false
+  }
+  if filter.Person != "" && !hasLabel(metadata.People, filter.Person) {
+    return false
+  }
+  if filter.Query != "" {
+    found := false
+    for _, field := range [...]string{metadata.Title, metadata.Description,
+        metadata.OriginalFileName} {
+      if strings.Contains(strings.ToLower(field), filter.Query) {
+        found = true
+        break
+      }
+    }
+    if !found {
+      return false
+    }
+  }
+  return true
+}
+
+// Search returns the videos matching filter, newest first.
+func (idx *VideoIndex) Search(filter VideoFilter) []IndexedVideo {
+  list := idx.List()
+  matches := list[:0]
+  for _, v := range list {
+    if filter.Matches(v.Metadata) {
+      matches = append(matches, v)
+    }
+  }
+  return matches
+}
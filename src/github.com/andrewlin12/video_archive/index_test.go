@@ -0,0 +1,77 @@
+package main
+
+import (
+  "net/url"
+  "testing"
+)
+
+func TestVideoFilterMatches(t *testing.T) {
+  video := VideoMetadata{
+    OriginalFileName: "IMG_0042.MOV",
+    Title: "Beach Day",
+    Description: "Building sandcastles",
+    Duration: 90,
+    Status: "Ready",
+    DateTaken: 1000,
+    Tags: []string{"summer"},
+    People: []string{"Grandpa Joe"},
+  }
+  deleted := video
+  deleted.DateDeleted = 2000
+
+  tests := []struct {
+    query string
+    metadata VideoMetadata
+    want bool
+  }{
+    {"", video, true},
+    {"", deleted, false},
+    {"from=1000&to=1000", video, true},
+    {"from=1001", video, false},
+    {"to=999", video, false},
+    {"minDuration=90&maxDuration=90", video, true},
+    {"minDuration=90.5", video, false},
+    {"maxDuration=89", video, false},
+    {"status=Ready", video, true},
+    {"status=Failed", video, false},
+    {"q=BEACH", video, true},
+    {"q=+sandcastle+", video, true},
+    {"q=img_0042", video, true},
+    {"q=mountain", video, false},
+    {"tag=Summer", video, true},
+    {"tag=winter", video, false},
+    {"person=grandpa++joe", video, true},
+    {"person=Grandma", video, false},
+    {"q=beach&status=Failed", video, false},
+  }
+  for _, test := range tests {
+    qs, err := url.ParseQuery(test.query)
+    if err != nil {
+      t.Fatal(err)
+    }
+    filter, err := parseVideoFilter(qs)
+    if err != nil {
+      t.Errorf("parseVideoFilter(%q): %v", test.query, err)
+      continue
+    }
+    if got := filter.Matches(test.metadata); got != test.want {
+      t.Errorf("%q matches %+v = %v, want %v", test.query, test.metadata,
+          got, test.want)
+    }
+  }
+
+  trash := VideoFilter{Deleted: true}
+  if !trash.Matches(deleted) || trash.Matches(video) {
+    t.Errorf("Deleted filter should match only videos in the trash")
+  }
+}
+
+func TestParseVideoFilterErrors(t *testing.T) {
+  for _, query := range []string{"from=yesterday", "to=1.5",
+      "minDuration=short", "maxDuration=x"} {
+    qs, _ := url.ParseQuery(query)
+    if _, err := parseVideoFilter(qs); err == nil {
+      t.Errorf("parseVideoFilter(%q) should fail", query)
+    }
+  }
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path"
+  "regexp"
+  "strings"
+  "time"
+  "github.com/gorilla/mux"
+  "launchpad.net/goamz/s3"
+)
+
+// The janitor clears away what interrupted work leaves behind: resumable
+// uploads that were never finished, files a crashed or failed job didn't
+// get to remove, and direct uploads that were never completed.  Anything
+// untouched for staleUploadHours that no job still needs is removed, and
+// done jobs are dropped from the journal after doneJobRetentionDays.
+
+// Files named after a video are <basename>_<what>, where <what> is the
+// source waiting to be transcoded, a downloaded original, a rendition, the
+// thumbnail, or an input to one of them.  Direct uploads are read back to
+// direct_<id><ext>.
+var videoFilePattern = regexp.MustCompile(
+    `^(-?[0-9]+_[0-9a-f]{32})_(source|original|1080|720|360|thumb)([._]|$)`)
+var directFilePattern = regexp.MustCompile(`^direct_([0-9a-f]+)(\.|$)`)
+
+// stagedFileOwner returns the video or direct upload a local file was made
+// for, or "" if it isn't one of ours.
+func stagedFileOwner(name string) string {
+  if match := videoFilePattern.FindStringSubmatch(name); match != nil {
+    return match[1]
+  }
+  if match := directFilePattern.FindStringSubmatch(name); match != nil {
+    return match[1]
+  }
+  return ""
+}
+
+// cleanStaleFiles removes files in uploadDir last changed before cutoff
+// that no job still needs.
+func cleanStaleFiles(cutoff time.Time) {
+  inUse := make(map[string]bool)
+  for _, job := range jobQueue.List() {
+    if job.State == JobQueued || job.State == JobRunning {
+      inUse[job.VideoId] = true
+      inUse[job.UploadId] = true
+    }
+    // NOTE: A failed job can be retried, which needs its source
+    if job.State != JobDone && job.SourcePath != "" {
+      inUse[path.Clean(job.SourcePath)] = true
+    }
+  }
+
+  fileInfos, err := ioutil.ReadDir(config.UploadDir)
+  if err != nil {
+    fmt.Printf("Could not list %s: %v\n", config.UploadDir, err)
+    return
+  }
+  for _, fileInfo := range fileInfos {
+    owner := stagedFileOwner(fileInfo.Name())
+    filePath := workPath(fileInfo.Name())
+    if owner == "" || fileInfo.IsDir() || inUse[owner] ||
+        inUse[filePath] || fileInfo.ModTime().After(cutoff) {
+      continue
+    }
+    err = os.Remove(filePath)
+    if err != nil {
+      fmt.Printf("Could not remove %s: %v\n", filePath, err)
+      continue
+    }
+    fmt.Printf("Removed stale file %s\n", filePath)
+  }
+}
+
+// cleanStaleDirectUploads removes direct uploads untouched since cutoff:
+// those never completed are aborted, and those processed, or whose
+// processing failed, are deleted along with what's left of the file.
+func cleanStaleDirectUploads(cutoff time.Time) {
+  bucket, ok := s3Bucket()
+  if !ok {
+    return
+  }
+  keys, _, err := listAll(storage, "uploads/", "/")
+  if err != nil {
+    fmt.Printf("Could not list direct uploads: %v\n", err)
+    return
+  }
+  for _, key := range keys {
+    if path.Ext(key) != ".json" {
+      continue
+    }
+    id := strings.TrimSuffix(path.Base(key), ".json")
+    err = removeStaleDirectUpload(bucket, id, cutoff)
+    if err != nil {
+      fmt.Printf("Could not remove direct upload %s: %v\n", id, err)
+    }
+  }
+}
+
+func removeStaleDirectUpload(bucket *s3.Bucket, id string,
+    cutoff time.Time) error {
+  // NOTE: Hold the lock so the upload can't be completed while it's being
+  //       thrown away
+  directUploadMutex.Lock()
+  defer directUploadMutex.Unlock()
+  upload, err := getDirectUpload(id)
+  if err != nil {
+    return err
+  }
+  lastChanged := upload.DateStarted
+  if job, ok := jobQueue.ForUpload(id); ok {
+    if job.State == JobQueued || job.State == JobRunning {
+      return nil
+    }
+    if job.DateUpdated > lastChanged {
+      lastChanged = job.DateUpdated
+    }
+  }
+  if lastChanged > cutoff.Unix() {
+    return nil
+  }
+
+  if !upload.Completed {
+    err = upload.multi(bucket).Abort()
+    if s3Err, ok := err.(*s3.Error); ok && s3Err.StatusCode == 404 {
+      err = nil
+    }
+  } else if upload.Result == nil {
+    err = storage.Delete(upload.Key)
+  }
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Removed stale direct upload %s of %s\n", id, upload.Filename)
+  return storage.Delete(directUploadKey(id))
+}
+
+// cleanUpForever runs the janitor once an hour.
+func cleanUpForever() {
+  ttl := time.Duration(config.StaleUploadHours) * time.Hour
+  jobRetention := time.Duration(config.DoneJobRetentionDays) * 24 * time.Hour
+  for {
+    jobQueue.Prune(time.Now().Add(-jobRetention))
+    cutoff := time.Now().Add(-ttl)
+    uploadSessions.RemoveStale(cutoff)
+    cleanStaleFiles(cutoff)
+    cleanStaleDirectUploads(cutoff)
+    time.Sleep(time.Hour)
+  }
+}
+
+type MultipartUploadJson struct {
+  Key string
+  UploadId string
+  Initiated string
+}
+
+// listMultipartUploads lists every unfinished multipart upload in the
+// bucket, whichever library it belongs to.
+func listMultipartUploads(w http.ResponseWriter, r *http.Request) {
+  bucket, ok := s3Bucket()
+  if !ok {
+    http.Error(w, "Multipart uploads need S3 storage", 404)
+    return
+  }
+  multis, _, err := bucket.ListMulti("", "")
+  if err != nil {
+    fmt.Printf("Could not list multipart uploads: %v\n", err)
+    http.Error(w, "Could not list multipart uploads", 500)
+    return
+  }
+  result := []MultipartUploadJson{}
+  for _, multi := range multis {
+    result = append(result, MultipartUploadJson{
+      Key: multi.Key,
+      UploadId: multi.UploadId,
+      Initiated: multi.Initiated,
+    })
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(result)
+}
+
+// abortMultipartUpload throws away the unfinished multipart upload with the
+// id in the URL, along with the direct upload it was for, if any.
+func abortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+  bucket, ok := s3Bucket()
+  if !ok {
+    http.Error(w, "Multipart uploads need S3 storage", 404)
+    return
+  }
+  multis, _, err := bucket.ListMulti("", "")
+  if err != nil {
+    fmt.Printf("Could not list multipart uploads: %v\n", err)
+    http.Error(w, "Could not list multipart uploads", 500)
+    return
+  }
+  var multi *s3.Multi
+  for _, m := range multis {
+    if m.UploadId == mux.Vars(r)["id"] {
+      multi = m
+    }
+  }
+  if multi == nil {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+
+  directUploadMutex.Lock()
+  defer directUploadMutex.Unlock()
+  err = multi.Abort()
+  if err != nil {
+    fmt.Printf("Could not abort multipart upload of %s: %v\n", multi.Key,
+        err)
+    http.Error(w, "Could not abort multipart upload", 500)
+    return
+  }
+  if strings.HasPrefix(multi.Key, "uploads/") {
+    id := strings.TrimSuffix(path.Base(multi.Key), path.Ext(multi.Key))
+    upload, err := getDirectUpload(id)
+    if err == nil && upload.UploadId == multi.UploadId {
+      storage.Delete(directUploadKey(id))
+    }
+  }
+  fmt.Printf("Aborted multipart upload of %s\n", multi.Key)
+  fmt.Fprintf(w, "Aborted")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestStagedFileOwner(t *testing.T) {
+  const basename = "1400000000_0123456789abcdef0123456789abcdef"
+  tests := []struct {
+    name string
+    want string
+  }{
+    {basename + "_source.mov", basename},
+    {basename + "_source", basename},
+    {basename + "_original.mp4", basename},
+    {basename + "_720.mp4", basename},
+    {basename + "_1080_rotated.mp4", basename},
+    {basename + "_thumb.jpg", basename},
+    {"-1_0123456789abcdef0123456789abcdef_360.mp4",
+        "-1_0123456789abcdef0123456789abcdef"},
+    {"direct_3f2a.mov", "3f2a"},
+    {"direct_3f2a", "3f2a"},
+    {basename + "_notes.txt", ""},
+    {basename + "_7200.mp4", ""},
+    {"1400000000_0123_720.mp4", ""},
+    {"direct_upload.mov", ""},
+    {"upload_alice+abc", ""},
+    {"somebody_elses_file", ""},
+  }
+  for _, test := range tests {
+    if got := stagedFileOwner(test.name); got != test.want {
+      t.Errorf("stagedFileOwner(%q) = %q, want %q", test.name, got,
+          test.want)
+    }
+  }
+}
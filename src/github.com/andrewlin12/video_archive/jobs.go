@@ -0,0 +1,589 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "os/exec"
+  "path"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  JobQueued = "queued"
+  JobRunning = "running"
+  JobFailed = "failed"
+  JobDone = "done"
+)
+
+// Higher priority jobs are started first.  Stream copies and thumbnails
+// finish in seconds, so they shouldn't wait behind a full transcode.
+const (
+  PriorityLow = 0
+  PriorityNormal = 5
+  PriorityHigh = 10
+)
+
+// A Job is a unit of ffmpeg work against a single video.  Every change to a
+// job is written to the journal directory before it takes effect, so the
+// queue can be rebuilt after a restart.
+type Job struct {
+  Id string
+  Type string
+  Library string
+  VideoId string
+  State string
+  Priority int
+
+  // Parameters for the job.  Which ones are used depends on Type.
+  SourcePath string
+  Degrees string
+  Width int
+  Height int
+  Duration float64
+  UploadId string `json:",omitempty"`
+  Force bool `json:",omitempty"`
+
+  // DoneSizes are the renditions a rotate or stripRotateTag job has already
+  // replaced, which later attempts skip.
+  DoneSizes []string `json:",omitempty"`
+
+  // Progress is the percentage of the current attempt that is complete and
+  // Eta the estimated seconds until it finishes.
+  Progress float64
+  Eta int64
+
+  Attempts int
+  LastError string
+  LastErrorDetail string
+  DateCreated int64
+  DateUpdated int64
+  DateStarted int64
+  NextAttempt int64
+}
+
+var ErrNoFailedJob = errors.New("No failed job for video")
+var ErrJobActive = errors.New("Video already has a job in progress")
+var ErrSourceMissing = errors.New("Source file is no longer available")
+
+// An FfmpegError is returned when ffmpeg exits unsuccessfully.  Stderr holds
+// the tail of its output, which usually says what went wrong.
+type FfmpegError struct {
+  Err error
+  Stderr string
+}
+
+func (e *FfmpegError) Error() string {
+  return fmt.Sprintf("ffmpeg: %v", e.Err)
+}
+
+var jobHandlers = map[string]func(*Library, *Job) error{
+  "transcode": runTranscodeJob,
+  "rotate": runRotateJob,
+  "stripRotateTag": runStripRotateTagJob,
+  "thumbnail": runThumbnailJob,
+  "ingest": runIngestJob,
+}
+
+type JobQueue struct {
+  dir string
+  maxAttempts int
+  mutex sync.Mutex
+  wake chan bool
+  jobs map[string]*Job
+  lastId int64
+}
+
+// NewJobQueue opens the journal in dir, creating it if needed.  Jobs that
+// were running when the process last exited are put back in the queue.
+func NewJobQueue(dir string, maxAttempts int) (*JobQueue, error) {
+  err := os.MkdirAll(dir, 0744)
+  if err != nil {
+    return nil, err
+  }
+
+  q := &JobQueue{
+    dir: dir,
+    maxAttempts: maxAttempts,
+    wake: make(chan bool, 1),
+    jobs: make(map[string]*Job),
+  }
+
+  fileInfos, err := ioutil.ReadDir(dir)
+  if err != nil {
+    return nil, err
+  }
+  for _, fileInfo := range fileInfos {
+    if path.Ext(fileInfo.Name()) != ".json" {
+      continue
+    }
+    data, err := ioutil.ReadFile(path.Join(dir, fileInfo.Name()))
+    if err != nil {
+      fmt.Printf("Could not read job %s: %v\n", fileInfo.Name(), err)
+      continue
+    }
+    var job Job
+    err = json.Unmarshal(data, &job)
+    if err != nil {
+      fmt.Printf("Could not parse job %s: %v\n", fileInfo.Name(), err)
+      continue
+    }
+    if job.State == JobRunning {
+      fmt.Printf("Resuming interrupted %s job %s\n", job.Type, job.Id)
+      job.State = JobQueued
+      job.NextAttempt = 0
+      q.save(&job)
+    }
+    q.jobs[job.Id] = &job
+  }
+
+  return q, nil
+}
+
+// Enqueue assigns job an id and adds it to the queue.
+func (q *JobQueue) Enqueue(job *Job) error {
+  q.mutex.Lock()
+  now := time.Now()
+  id := now.UnixNano()
+  if id <= q.lastId {
+    id = q.lastId + 1
+  }
+  q.lastId = id
+  job.Id = fmt.Sprintf("%d_%s", id, job.VideoId)
+  job.State = JobQueued
+  job.DateCreated = now.Unix()
+  job.DateUpdated = now.Unix()
+  err := q.save(job)
+  if err == nil {
+    q.jobs[job.Id] = job
+  }
+  q.mutex.Unlock()
+
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Queued %s job %s\n", job.Type, job.Id)
+  q.signal()
+  return nil
+}
+
+// Start launches workers goroutines that process jobs forever.
+func (q *JobQueue) Start(workers int) {
+  if workers < 1 {
+    workers = 1
+  }
+  fmt.Printf("Starting %d transcode workers\n", workers)
+  for i := 0; i < workers; i++ {
+    go q.work()
+  }
+}
+
+func (q *JobQueue) work() {
+  for {
+    job := q.next()
+    if job == nil {
+      select {
+      case <-q.wake:
+      case <-time.After(time.Second):
+      }
+      continue
+    }
+
+    fmt.Printf("Starting %s job %s (attempt %d)\n", job.Type, job.Id,
+        job.Attempts)
+    handler, ok := jobHandlers[job.Type]
+    lib, err := libraries.Open(job.Library)
+    if err != nil {
+      err = fmt.Errorf("Could not open library: %v", err)
+    } else if !ok {
+      err = fmt.Errorf("Unknown job type %s", job.Type)
+    } else {
+      err = handler(lib, job)
+    }
+    // NOTE: Ingest jobs don't have a video until they succeed
+    if q.finish(job, err) && lib != nil && job.VideoId != "" {
+      lib.markVideoFailed(job.VideoId, job.LastError, job.LastErrorDetail)
+    }
+    q.signal()
+  }
+}
+
+// videoKey identifies the job's video across every library.  Ingest jobs
+// don't have a video yet, so each direct upload is ordered on its own.
+func (job *Job) videoKey() string {
+  if job.VideoId == "" {
+    return "upload:" + job.UploadId
+  }
+  return job.Library + "/" + job.VideoId
+}
+
+func (q *JobQueue) signal() {
+  select {
+  case q.wake <- true:
+  default:
+  }
+}
+
+// next claims the highest priority job that is due to run, or returns nil.
+// Jobs for the same video always run one at a time in the order they were
+// queued, since they read and write the same renditions.
+func (q *JobQueue) next() *Job {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  now := time.Now().Unix()
+  oldest := make(map[string]*Job)
+  for _, job := range q.jobs {
+    if job.State != JobQueued && job.State != JobRunning {
+      continue
+    }
+    current := oldest[job.videoKey()]
+    if current == nil || job.Id < current.Id {
+      oldest[job.videoKey()] = job
+    }
+  }
+
+  var found *Job
+  for _, job := range oldest {
+    if job.State != JobQueued || job.NextAttempt > now {
+      continue
+    }
+    if found == nil || job.Priority > found.Priority ||
+        (job.Priority == found.Priority && job.Id < found.Id) {
+      found = job
+    }
+  }
+  if found == nil {
+    return nil
+  }
+
+  found.State = JobRunning
+  found.Attempts++
+  found.Progress = 0
+  found.Eta = 0
+  found.DateStarted = now
+  found.DateUpdated = now
+  q.save(found)
+  return found
+}
+
+// finish records the outcome of running job, scheduling a retry if it
+// failed.  It returns true if the job has failed for good.
+func (q *JobQueue) finish(job *Job, err error) bool {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  job.DateUpdated = time.Now().Unix()
+  job.LastErrorDetail = ""
+  if ffmpegErr, ok := err.(*FfmpegError); ok {
+    job.LastErrorDetail = ffmpegErr.Stderr
+  }
+  if err == nil {
+    job.State = JobDone
+    job.LastError = ""
+    job.Progress = 100
+    job.Eta = 0
+    fmt.Printf("Job %s complete\n", job.Id)
+  } else if job.Attempts >= q.maxAttempts {
+    job.State = JobFailed
+    job.LastError = err.Error()
+    fmt.Printf("Job %s failed permanently: %v\n", job.Id, err)
+  } else {
+    job.State = JobQueued
+    job.LastError = err.Error()
+    backoff := retryBackoff(job.Attempts)
+    job.NextAttempt = time.Now().Add(backoff).Unix()
+    fmt.Printf("Job %s failed, retrying in %v: %v\n", job.Id, backoff, err)
+  }
+  q.save(job)
+  return job.State == JobFailed
+}
+
+// Retry queues a fresh copy of the most recent failed job for basename in
+// library.
+func (q *JobQueue) Retry(library string, basename string) (*Job, error) {
+  return q.retry(func(job *Job) bool {
+    return job.Library == library && job.VideoId == basename
+  })
+}
+
+// RetryUpload queues a fresh copy of the failed ingest job for the direct
+// upload uploadId.
+func (q *JobQueue) RetryUpload(uploadId string) (*Job, error) {
+  return q.retry(func(job *Job) bool {
+    return job.UploadId == uploadId
+  })
+}
+
+// retry queues a fresh copy of the most recent failed job that match
+// picks out, unless one of them is still queued or running.
+func (q *JobQueue) retry(match func(job *Job) bool) (*Job, error) {
+  q.mutex.Lock()
+  var failed *Job
+  for _, job := range q.jobs {
+    if !match(job) {
+      continue
+    }
+    if job.State == JobQueued || job.State == JobRunning {
+      q.mutex.Unlock()
+      return nil, ErrJobActive
+    }
+    if job.State == JobFailed && (failed == nil || job.Id > failed.Id) {
+      failed = job
+    }
+  }
+  q.mutex.Unlock()
+
+  if failed == nil {
+    return nil, ErrNoFailedJob
+  }
+  if failed.SourcePath != "" {
+    _, err := os.Stat(failed.SourcePath)
+    if err != nil {
+      return nil, ErrSourceMissing
+    }
+  }
+
+  job := &Job{
+    Type: failed.Type,
+    Library: failed.Library,
+    VideoId: failed.VideoId,
+    Priority: failed.Priority,
+    SourcePath: failed.SourcePath,
+    Degrees: failed.Degrees,
+    Width: failed.Width,
+    Height: failed.Height,
+    Duration: failed.Duration,
+    UploadId: failed.UploadId,
+    Force: failed.Force,
+    DoneSizes: failed.DoneSizes,
+  }
+  return job, q.Enqueue(job)
+}
+
+// Prune forgets done jobs last updated before cutoff, removing them from
+// the journal too.  Failed jobs are kept so they can still be retried.
+func (q *JobQueue) Prune(cutoff time.Time) {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  for id, job := range q.jobs {
+    if job.State != JobDone || job.DateUpdated > cutoff.Unix() {
+      continue
+    }
+    err := os.Remove(path.Join(q.dir, id + ".json"))
+    if err != nil && !os.IsNotExist(err) {
+      fmt.Printf("Could not remove job %s: %v\n", id, err)
+      continue
+    }
+    delete(q.jobs, id)
+    fmt.Printf("Pruned done job %s\n", id)
+  }
+}
+
+// List returns a snapshot of every job, newest first.
+func (q *JobQueue) List() []Job {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  list := make([]Job, 0, len(q.jobs))
+  for _, job := range q.jobs {
+    list = append(list, *job)
+  }
+  sort.Sort(jobsByNewest(list))
+  return list
+}
+
+// ForVideo returns a snapshot of the job currently working on basename in
+// library, or the most recent one if none are.
+func (q *JobQueue) ForVideo(library string, basename string) (Job, bool) {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  var active, latest *Job
+  for _, job := range q.jobs {
+    if job.Library != library || job.VideoId != basename {
+      continue
+    }
+    if (job.State == JobQueued || job.State == JobRunning) &&
+        (active == nil || job.Id < active.Id) {
+      active = job
+    }
+    if latest == nil || job.Id > latest.Id {
+      latest = job
+    }
+  }
+  if active != nil {
+    return *active, true
+  }
+  if latest != nil {
+    return *latest, true
+  }
+  return Job{}, false
+}
+
+// ForUpload returns a snapshot of the newest ingest job for the direct
+// upload uploadId.
+func (q *JobQueue) ForUpload(uploadId string) (Job, bool) {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  var latest *Job
+  for _, job := range q.jobs {
+    if job.UploadId == uploadId && (latest == nil || job.Id > latest.Id) {
+      latest = job
+    }
+  }
+  if latest == nil {
+    return Job{}, false
+  }
+  return *latest, true
+}
+
+// HasActiveJob returns true if basename in library has a job queued or
+// running.
+func (q *JobQueue) HasActiveJob(library string, basename string) bool {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  for _, job := range q.jobs {
+    if job.Library == library && job.VideoId == basename &&
+        (job.State == JobQueued || job.State == JobRunning) {
+      return true
+    }
+  }
+  return false
+}
+
+type jobsByNewest []Job
+
+func (s jobsByNewest) Len() int { return len(s) }
+func (s jobsByNewest) Less(i, j int) bool { return s[i].Id > s[j].Id }
+func (s jobsByNewest) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (q *JobQueue) setProgress(job *Job, fraction float64) {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  if fraction > 1 {
+    fraction = 1
+  }
+  job.Progress = fraction * 100
+  if fraction > 0 {
+    elapsed := float64(time.Now().Unix() - job.DateStarted)
+    job.Eta = int64(elapsed * (1 - fraction) / fraction)
+  }
+}
+
+// finishSize records that job has replaced size's rendition.
+func (q *JobQueue) finishSize(job *Job, size string) error {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+  job.DoneSizes = append(job.DoneSizes, size)
+  return q.save(job)
+}
+
+func (job *Job) sizeDone(size string) bool {
+  for _, done := range job.DoneSizes {
+    if done == size {
+      return true
+    }
+  }
+  return false
+}
+
+// retryBackoff doubles the wait after every attempt, up to an hour.
+func retryBackoff(attempts int) time.Duration {
+  backoff := 30 * time.Second
+  for i := 1; i < attempts && backoff < time.Hour; i++ {
+    backoff *= 2
+  }
+  if backoff > time.Hour {
+    backoff = time.Hour
+  }
+  return backoff
+}
+
+// save writes job to the journal.  The write goes to a temporary file first
+// so a crash never leaves a half-written job behind.
+func (q *JobQueue) save(job *Job) error {
+  data, err := json.Marshal(job)
+  if err != nil {
+    return err
+  }
+  jobPath := path.Join(q.dir, job.Id + ".json")
+  tempPath := jobPath + ".tmp"
+  err = ioutil.WriteFile(tempPath, data, 0644)
+  if err == nil {
+    err = os.Rename(tempPath, jobPath)
+  }
+  if err != nil {
+    fmt.Printf("Could not save job %s: %v\n", job.Id, err)
+  }
+  return err
+}
+
+// runFfmpeg runs ffmpeg with args as the step'th of steps ffmpeg runs that
+// make up job.  Progress is read from ffmpeg's -progress output and measured
+// against job.Duration.
+func (q *JobQueue) runFfmpeg(job *Job, step int, steps int,
+    args ...string) error {
+  cmd := exec.Command("ffmpeg",
+      append([]string{"-progress", "pipe:1"}, args...)...)
+  stderr := &tailWriter{max: 4096}
+  cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+  stdout, err := cmd.StdoutPipe()
+  if err != nil {
+    return err
+  }
+  err = cmd.Start()
+  if err != nil {
+    return fmt.Errorf("ffmpeg: %v", err)
+  }
+
+  scanner := bufio.NewScanner(stdout)
+  for scanner.Scan() {
+    // NOTE: Despite the name, out_time_ms is in microseconds
+    parts := strings.SplitN(scanner.Text(), "=", 2)
+    if len(parts) != 2 || parts[0] != "out_time_ms" || job.Duration <= 0 {
+      continue
+    }
+    outTime, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil {
+      continue
+    }
+    fraction := float64(outTime) / 1000000 / job.Duration
+    if fraction > 1 {
+      fraction = 1
+    }
+    q.setProgress(job, (float64(step) + fraction) / float64(steps))
+  }
+
+  err = cmd.Wait()
+  if err != nil {
+    return &FfmpegError{Err: err, Stderr: string(stderr.data)}
+  }
+  return nil
+}
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+  max int
+  data []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+  t.data = append(t.data, p...)
+  if len(t.data) > t.max {
+    t.data = t.data[len(t.data) - t.max:]
+  }
+  return len(p), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path"
+  "testing"
+  "time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+  tests := []struct {
+    attempts int
+    want time.Duration
+  }{
+    {0, 30 * time.Second},
+    {1, 30 * time.Second},
+    {2, time.Minute},
+    {3, 2 * time.Minute},
+    {7, 32 * time.Minute},
+    {8, time.Hour},
+    {100, time.Hour},
+  }
+  for _, test := range tests {
+    if got := retryBackoff(test.attempts); got != test.want {
+      t.Errorf("retryBackoff(%d) = %v, want %v", test.attempts, got,
+          test.want)
+    }
+  }
+}
+
+func TestJobQueuePrune(t *testing.T) {
+  q, cleanup := newTestJobQueue(t)
+  defer cleanup()
+
+  now := time.Now()
+  old := now.Add(-48 * time.Hour).Unix()
+  jobs := []struct {
+    job Job
+    kept bool
+  }{
+    {Job{Id: "1_old_done", State: JobDone, DateUpdated: old}, false},
+    {Job{Id: "2_new_done", State: JobDone, DateUpdated: now.Unix()}, true},
+    {Job{Id: "3_old_failed", State: JobFailed, DateUpdated: old}, true},
+    {Job{Id: "4_old_queued", State: JobQueued, DateUpdated: old}, true},
+  }
+  for i := range jobs {
+    job := jobs[i].job
+    q.jobs[job.Id] = &job
+    q.save(&job)
+  }
+
+  q.Prune(now.Add(-24 * time.Hour))
+  for _, test := range jobs {
+    _, inMemory := q.jobs[test.job.Id]
+    _, err := os.Stat(path.Join(q.dir, test.job.Id + ".json"))
+    if inMemory != test.kept || (err == nil) != test.kept {
+      t.Errorf("Job %s: in memory %v, on disk %v, want kept %v",
+          test.job.Id, inMemory, err == nil, test.kept)
+    }
+  }
+}
+
+// newTestJobQueue returns an empty JobQueue journaled to a temporary
+// directory.  Call the returned func to remove it.
+func newTestJobQueue(t *testing.T) (*JobQueue, func()) {
+  dir, err := ioutil.TempDir("", "jobs_test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  q, err := NewJobQueue(dir, 5)
+  if err != nil {
+    os.RemoveAll(dir)
+    t.Fatal(err)
+  }
+  return q, func() { os.RemoveAll(dir) }
+}
+
+func TestNextIngestsRunIndependently(t *testing.T) {
+  q, cleanup := newTestJobQueue(t)
+  defer cleanup()
+
+  backedOff := &Job{Type: "ingest", Library: "alice", UploadId: "aaaa"}
+  waiting := &Job{Type: "ingest", Library: "alice", UploadId: "bbbb"}
+  for _, job := range []*Job{backedOff, waiting} {
+    err := q.Enqueue(job)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  backedOff.NextAttempt = time.Now().Add(time.Hour).Unix()
+
+  if job := q.next(); job != waiting {
+    t.Fatalf("next() = %v, want the other upload's ingest", job)
+  }
+  if job := q.next(); job != nil {
+    t.Errorf("next() = %v, want nothing while the first ingest backs off",
+        job)
+  }
+}
+
+func TestNewJobQueueResumesRunningJobs(t *testing.T) {
+  q, cleanup := newTestJobQueue(t)
+  defer cleanup()
+
+  jobs := []Job{
+    {Id: "1_running", State: JobRunning, Attempts: 1, NextAttempt: 99},
+    {Id: "2_queued", State: JobQueued},
+    {Id: "3_failed", State: JobFailed},
+    {Id: "4_done", State: JobDone},
+  }
+  for i := range jobs {
+    q.save(&jobs[i])
+  }
+  err := ioutil.WriteFile(path.Join(q.dir, "5_garbage.json"), []byte("{"),
+      0644)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // NOTE: Reopening the journal is what happens after a crash
+  q, err = NewJobQueue(q.dir, 5)
+  if err != nil {
+    t.Fatal(err)
+  }
+  want := map[string]string{
+    "1_running": JobQueued,
+    "2_queued": JobQueued,
+    "3_failed": JobFailed,
+    "4_done": JobDone,
+  }
+  if len(q.jobs) != len(want) {
+    t.Errorf("Loaded %d jobs, want %d", len(q.jobs), len(want))
+  }
+  for id, state := range want {
+    job := q.jobs[id]
+    if job == nil || job.State != state {
+      t.Errorf("Job %s: got %+v, want state %s", id, job, state)
+    }
+  }
+  if job := q.jobs["1_running"]; job != nil &&
+      (job.NextAttempt != 0 || job.Attempts != 1) {
+    t.Errorf("Resumed job should run now and keep its attempts: %+v", job)
+  }
+
+  // The resumed state is journaled too
+  q, err = NewJobQueue(q.dir, 5)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if job := q.jobs["1_running"]; job == nil || job.State != JobQueued {
+    t.Errorf("Resumed job not journaled: %+v", job)
+  }
+}
+
+func TestNextOrderAndPriority(t *testing.T) {
+  q, cleanup := newTestJobQueue(t)
+  defer cleanup()
+
+  // NOTE: a2 has the highest priority but must wait for a1, which was
+  //       queued first for the same video
+  a1 := &Job{Type: "transcode", VideoId: "a", Priority: PriorityLow}
+  a2 := &Job{Type: "thumbnail", VideoId: "a", Priority: PriorityHigh}
+  b1 := &Job{Type: "transcode", VideoId: "b", Priority: PriorityNormal}
+  c1 := &Job{Type: "thumbnail", VideoId: "c", Priority: PriorityHigh}
+  otherLibrary := &Job{Type: "transcode", Library: "bob", VideoId: "a",
+      Priority: PriorityLow}
+  for _, job := range []*Job{a1, a2, b1, c1, otherLibrary} {
+    err := q.Enqueue(job)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  for _, want := range []*Job{c1, b1, a1, otherLibrary, nil} {
+    if got := q.next(); got != want {
+      t.Fatalf("next() = %+v, want %+v", got, want)
+    }
+  }
+  if a1.State != JobRunning || a1.Attempts != 1 {
+    t.Errorf("Claimed job should be running its first attempt: %+v", a1)
+  }
+
+  q.finish(a1, nil)
+  if got := q.next(); got != a2 {
+    t.Errorf("next() after a1 finished = %+v, want a2", got)
+  }
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "sort"
+  "strings"
+)
+
+// normalizeLabel trims a tag or person's name and collapses inner
+// whitespace.  Tags are also lowercased so "Beach" and "beach" are the same
+// tag, but people's names keep their case.
+func normalizeLabel(label string, lower bool) string {
+  label = strings.Join(strings.Fields(label), " ")
+  if lower {
+    label = strings.ToLower(label)
+  }
+  return label
+}
+
+// normalizeLabels normalizes labels and drops blanks and duplicates.
+func normalizeLabels(labels []string, lower bool) ([]string, error) {
+  result := []string{}
+  seen := make(map[string]bool)
+  for _, label := range labels {
+    label = normalizeLabel(label, lower)
+    if label == "" || seen[strings.ToLower(label)] {
+      continue
+    }
+    if len(label) > 100 {
+      return nil, fmt.Errorf("Label %q is longer than 100 characters", label)
+    }
+    seen[strings.ToLower(label)] = true
+    result = append(result, label)
+  }
+  return result, nil
+}
+
+// mergeLabels returns labels with add appended and remove taken out,
+// comparing case-insensitively.
+func mergeLabels(labels []string, add []string, remove []string) []string {
+  removed := make(map[string]bool)
+  for _, label := range remove {
+    removed[strings.ToLower(label)] = true
+  }
+  result := []string{}
+  seen := make(map[string]bool)
+  for _, list := range [][]string{labels, add} {
+    for _, label := range list {
+      key := strings.ToLower(label)
+      if removed[key] || seen[key] {
+        continue
+      }
+      seen[key] = true
+      result = append(result, label)
+    }
+  }
+  return result
+}
+
+func hasLabel(labels []string, label string) bool {
+  for _, l := range labels {
+    if strings.EqualFold(l, label) {
+      return true
+    }
+  }
+  return false
+}
+
+// A LabelsRequest is the body of POST /labels, which adds and removes tags
+// and people on every video in Ids.
+type LabelsRequest struct {
+  Ids []string
+  AddTags []string
+  RemoveTags []string
+  AddPeople []string
+  RemovePeople []string
+}
+
+func (req *LabelsRequest) normalize() error {
+  var err error
+  for _, labels := range []*[]string{&req.AddTags, &req.RemoveTags} {
+    *labels, err = normalizeLabels(*labels, true)
+    if err != nil {
+      return err
+    }
+  }
+  for _, labels := range []*[]string{&req.AddPeople, &req.RemovePeople} {
+    *labels, err = normalizeLabels(*labels, false)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+type LabelsJson struct {
+  Updated map[string]VideoJson
+  Errors map[string]string
+}
+
+func labelVideos(w http.ResponseWriter, r *http.Request) {
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  var req LabelsRequest
+  err := json.NewDecoder(io.LimitReader(r.Body, 1024 * 1024)).Decode(&req)
+  if err != nil {
+    http.Error(w, "Invalid JSON body", 400)
+    return
+  }
+  if len(req.Ids) == 0 {
+    http.Error(w, "No videos given", 400)
+    return
+  }
+  err = req.normalize()
+  if err != nil {
+    http.Error(w, err.Error(), 400)
+    return
+  }
+
+  result := LabelsJson{
+    Updated: make(map[string]VideoJson),
+    Errors: make(map[string]string),
+  }
+  for _, basename := range req.Ids {
+    if _, ok := lib.index.Get(basename); !ok {
+      result.Errors[basename] = "Not Found"
+      continue
+    }
+    metadata, err := lib.updateMetadata(basename,
+        func(metadata *VideoMetadata) error {
+      metadata.Tags = mergeLabels(metadata.Tags, req.AddTags, req.RemoveTags)
+      metadata.People = mergeLabels(metadata.People, req.AddPeople,
+          req.RemovePeople)
+      return nil
+    })
+    if err != nil {
+      fmt.Printf("Could not label %s: %v\n", basename, err)
+      result.Errors[basename] = "Could not update video"
+      continue
+    }
+    result.Updated[basename] = VideoJson{
+      VideoMetadata: metadata,
+      Urls: lib.getVideoUrls(basename),
+    }
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(result)
+}
+
+type LabelCount struct {
+  Name string
+  Count int
+}
+
+type labelsByCount []LabelCount
+
+func (s labelsByCount) Len() int { return len(s) }
+func (s labelsByCount) Less(i, j int) bool {
+  if s[i].Count != s[j].Count {
+    return s[i].Count > s[j].Count
+  }
+  return s[i].Name < s[j].Name
+}
+func (s labelsByCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+type TagsJson struct {
+  Tags []LabelCount
+  People []LabelCount
+}
+
+// countLabels tallies labels across every video, most used first.
+func countLabels(list []IndexedVideo,
+    get func(VideoMetadata) []string) []LabelCount {
+  counts := make(map[string]int)
+  for _, v := range list {
+    for _, label := range get(v.Metadata) {
+      counts[label]++
+    }
+  }
+  result := []LabelCount{}
+  for name, count := range counts {
+    result = append(result, LabelCount{Name: name, Count: count})
+  }
+  sort.Sort(labelsByCount(result))
+  return result
+}
+
+func tags(w http.ResponseWriter, r *http.Request) {
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  list := lib.index.Search(VideoFilter{})
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(TagsJson{
+    Tags: countLabels(list, func(metadata VideoMetadata) []string {
+      return metadata.Tags
+    }),
+    People: countLabels(list, func(metadata VideoMetadata) []string {
+      return metadata.People
+    }),
+  })
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "regexp"
+  "strings"
+  "sync"
+)
+
+// A Library is a set of videos with its own index and albums.  Each user
+// belongs to one library, and several users can share one.  The default
+// library, named "", is the bucket root where the archive kept everything
+// before libraries existed; the rest live under libraries/<name>/.
+type Library struct {
+  Name string
+  storage Storage
+  index *VideoIndex
+}
+
+// LibrarySet opens libraries as they are first used.
+type LibrarySet struct {
+  mutex sync.Mutex
+  rebuild bool
+  libraries map[string]*Library
+}
+
+func NewLibrarySet(rebuild bool) *LibrarySet {
+  return &LibrarySet{rebuild: rebuild, libraries: make(map[string]*Library)}
+}
+
+var validNamePattern = regexp.MustCompile(`^[A-Za-z0-9_@-][A-Za-z0-9_.@-]*$`)
+
+// validName returns true if name can be used as a username or library name,
+// which end up in storage keys.
+func validName(name string) bool {
+  return len(name) <= 100 && validNamePattern.MatchString(name)
+}
+
+func libraryPrefix(name string) string {
+  if name == "" {
+    return ""
+  }
+  return "libraries/" + name + "/"
+}
+
+// Open returns the library called name, loading its index the first time.
+func (set *LibrarySet) Open(name string) (*Library, error) {
+  set.mutex.Lock()
+  defer set.mutex.Unlock()
+
+  if lib, ok := set.libraries[name]; ok {
+    return lib, nil
+  }
+  if name != "" && !validName(name) {
+    return nil, fmt.Errorf("Invalid library name %q", name)
+  }
+
+  lib := &Library{Name: name, storage: storage}
+  if name != "" {
+    lib.storage = &PrefixStorage{Storage: storage, prefix: libraryPrefix(name)}
+  }
+  var err error
+  lib.index, err = LoadVideoIndex(lib.storage, "index.json", set.rebuild)
+  if err != nil {
+    return nil, err
+  }
+  set.libraries[name] = lib
+  return lib, nil
+}
+
+// List returns every library opened so far.
+func (set *LibrarySet) List() []*Library {
+  set.mutex.Lock()
+  defer set.mutex.Unlock()
+  list := make([]*Library, 0, len(set.libraries))
+  for _, lib := range set.libraries {
+    list = append(list, lib)
+  }
+  return list
+}
+
+// requestLibrary returns the logged in user's library, writing an error if
+// it can't be opened.
+func requestLibrary(w http.ResponseWriter, r *http.Request) (*Library,
+    bool) {
+  user, _ := currentUser(r)
+  lib, err := libraries.Open(user.Library)
+  if err != nil {
+    fmt.Printf("Could not open library %q: %v\n", user.Library, err)
+    http.Error(w, "Could not open library", 500)
+    return nil, false
+  }
+  return lib, true
+}
+
+// serveLocalStorage serves files from local storage, but only those
+// belonging to a video in the logged in user's library.  Everything else,
+// like shares, uploads and indexes, stays private, and folders are never
+// listed.
+func serveLocalStorage(localStorage *LocalStorage) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    lib, ok := requestLibrary(w, r)
+    if !ok {
+      return
+    }
+    key := strings.TrimPrefix(r.URL.Path, localStorage.urlPrefix)
+    prefix := libraryPrefix(lib.Name)
+    parts := strings.Split(strings.TrimPrefix(key, prefix), "/")
+    if !strings.HasPrefix(key, prefix) || len(parts) != 2 ||
+        parts[1] == "" || parts[1] == "." || parts[1] == ".." {
+      http.Error(w, "Not Found", 404)
+      return
+    }
+    if _, ok := lib.index.Get(parts[0]); !ok {
+      http.Error(w, "Not Found", 404)
+      return
+    }
+    serveObject(w, r, lib.storage, parts[0] + "/" + parts[1])
+  }
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+  "fmt"
+  "mime"
+  "net/http"
+  "github.com/gorilla/mux"
+)
+
+// reprocess applies change to basename's metadata and queues a transcode
+// that remakes its renditions and thumbnail from the original.
+func (lib *Library) reprocess(basename string,
+    change func(*VideoMetadata)) error {
+  // NOTE: Mark the video Processing before the job is queued, so a quick
+  //       job can't finish first and have its Ready status overwritten
+  metadata, err := lib.updateMetadata(basename,
+      func(metadata *VideoMetadata) error {
+    change(metadata)
+    metadata.Status = "Processing"
+    metadata.Error = ""
+    metadata.ErrorDetail = ""
+    metadata.DateFailed = 0
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+
+  degrees, width, height := metadata.renderRotation()
+  return jobQueue.Enqueue(&Job{
+    Type: "transcode",
+    Library: lib.Name,
+    VideoId: basename,
+    Priority: PriorityNormal,
+    Degrees: degrees,
+    Width: width,
+    Height: height,
+    Duration: metadata.Duration,
+  })
+}
+
+// reprocessVideo remakes a video's renditions from its original, e.g. after
+// the rendition sizes or encoder settings change.
+func reprocessVideo(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  basename := vars["id"]
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  metadata, ok := lib.index.Get(basename)
+  if !ok {
+    http.Error(w, "Not Found", 404)
+    return
+  } else if metadata.Original == "" {
+    http.Error(w, "No original kept for this video", 404)
+    return
+  }
+
+  err := lib.reprocess(basename, func(metadata *VideoMetadata) {})
+  if err != nil {
+    fmt.Printf("Could not reprocess %s: %v\n", basename, err)
+    http.Error(w, "Could not queue reprocessing", 500)
+    return
+  }
+  fmt.Fprintf(w, "Reprocessing")
+}
+
+// downloadOriginal sends the file as it was uploaded, under its original
+// name.
+func downloadOriginal(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  metadata, ok := lib.index.Get(vars["id"])
+  if !ok {
+    http.Error(w, "Not Found", 404)
+    return
+  } else if metadata.Original == "" {
+    http.Error(w, "No original kept for this video", 404)
+    return
+  }
+
+  w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+      map[string]string{"filename": metadata.OriginalFileName}))
+  serveObject(w, r, lib.storage, metadata.Original)
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "path"
+  "strings"
+  "time"
+  "github.com/gorilla/mux"
+  "golang.org/x/crypto/bcrypt"
+)
+
+// A Share lets anyone holding its token watch one video or album without
+// logging in, until it expires.  Shares are stored as shares/<token>.json
+// at the bucket root, whichever library the video or album is in.
+type Share struct {
+  Token string
+  Library string
+  Kind string
+  TargetId string
+  DateCreated int64
+  Expires int64
+  PasswordHash string `json:",omitempty"`
+}
+
+// A ShareRequest is the body of POST /share.  Kind is "video" or "album",
+// and ExpiresIn is in seconds.
+type ShareRequest struct {
+  Kind string
+  Id string
+  ExpiresIn int64
+  Password string
+}
+
+type ShareJson struct {
+  Token string
+  Kind string
+  TargetId string
+  DateCreated int64
+  Expires int64
+  HasPassword bool
+  Url string
+}
+
+const maxShareDuration = 365 * 24 * time.Hour
+
+// cookieSecret signs cookies handed out by the server.  Without one in
+// config.json, a random secret is made at startup and cookies don't
+// survive a restart.
+var cookieSecret []byte
+
+// minCookieSecretLength is 128 bits' worth of hex.  The 64 characters of
+// "openssl rand -hex 32", as the README suggests, clear it easily.
+const minCookieSecretLength = 32
+
+// The placeholder shipped in config.json.example before it was left blank.
+// Anyone who copied it would be signing cookies with a public key.
+const exampleCookieSecret = "some long random string"
+
+// initCookieSecret sets cookieSecret from config.json, refusing secrets
+// that are known or too short to resist guessing.
+func initCookieSecret() error {
+  if config.CookieSecret == exampleCookieSecret {
+    return fmt.Errorf("cookieSecret is the example value, generate one " +
+        "with: openssl rand -hex 32")
+  }
+  if config.CookieSecret != "" {
+    if len(config.CookieSecret) < minCookieSecretLength {
+      return fmt.Errorf("cookieSecret must be at least %d characters",
+          minCookieSecretLength)
+    }
+    cookieSecret = []byte(config.CookieSecret)
+    return nil
+  }
+  fmt.Printf("No cookieSecret in config.json, cookies will not survive " +
+      "a restart\n")
+  cookieSecret = make([]byte, 32)
+  _, err := rand.Read(cookieSecret)
+  return err
+}
+
+// signValue returns an HMAC of value that only this server can produce.
+func signValue(value string) string {
+  mac := hmac.New(sha256.New, cookieSecret)
+  io.WriteString(mac, value)
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+func shareKey(token string) string {
+  return "shares/" + token + ".json"
+}
+
+func getShare(token string) (Share, error) {
+  var share Share
+  data, err := storage.Get(shareKey(token))
+  if err != nil {
+    return share, err
+  }
+  err = json.Unmarshal(data, &share)
+  return share, err
+}
+
+func (share Share) expired() bool {
+  return time.Now().Unix() >= share.Expires
+}
+
+func (share Share) toJson() ShareJson {
+  return ShareJson{
+    Token: share.Token,
+    Kind: share.Kind,
+    TargetId: share.TargetId,
+    DateCreated: share.DateCreated,
+    Expires: share.Expires,
+    HasPassword: share.PasswordHash != "",
+    Url: "/s/" + share.Token,
+  }
+}
+
+// videoIds returns the videos in lib the share grants access to.
+func (share Share) videoIds(lib *Library) ([]string, error) {
+  if share.Kind == "album" {
+    album, err := lib.getAlbum(share.TargetId)
+    if err != nil {
+      return nil, err
+    }
+    return album.VideoIds, nil
+  }
+  return []string{share.TargetId}, nil
+}
+
+func createShare(w http.ResponseWriter, r *http.Request) {
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  var req ShareRequest
+  err := json.NewDecoder(io.LimitReader(r.Body, 64 * 1024)).Decode(&req)
+  if err != nil {
+    http.Error(w, "Invalid JSON body", 400)
+    return
+  }
+
+  if req.Kind == "video" {
+    if metadata, ok := lib.index.Get(req.Id); !ok ||
+        metadata.DateDeleted != 0 {
+      http.Error(w, "No such video", 400)
+      return
+    }
+  } else if req.Kind == "album" {
+    if _, err := lib.getAlbum(req.Id); err != nil {
+      http.Error(w, "No such album", 400)
+      return
+    }
+  } else {
+    http.Error(w, "Kind must be video or album", 400)
+    return
+  }
+  expiresIn := time.Duration(req.ExpiresIn) * time.Second
+  if expiresIn <= 0 || expiresIn > maxShareDuration {
+    http.Error(w, "ExpiresIn must be between 1 second and 365 days", 400)
+    return
+  }
+
+  now := time.Now()
+  share := Share{
+    Token: newId(),
+    Library: lib.Name,
+    Kind: req.Kind,
+    TargetId: req.Id,
+    DateCreated: now.Unix(),
+    Expires: now.Add(expiresIn).Unix(),
+  }
+  if req.Password != "" {
+    hash, err := bcrypt.GenerateFromPassword([]byte(req.Password),
+        bcrypt.DefaultCost)
+    if err != nil {
+      http.Error(w, "Invalid password", 400)
+      return
+    }
+    share.PasswordHash = string(hash)
+  }
+
+  data, _ := json.Marshal(share)
+  err = storage.Put(shareKey(share.Token), data, "text/json")
+  if err != nil {
+    fmt.Printf("Could not save share: %v\n", err)
+    http.Error(w, "Could not save share", 500)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(201)
+  json.NewEncoder(w).Encode(share.toJson())
+}
+
+// shares lists the shares of the logged in user's library.
+func shares(w http.ResponseWriter, r *http.Request) {
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  keys, _, err := listAll(storage, "shares/", "")
+  if err != nil {
+    fmt.Printf("Could not list shares: %v\n", err)
+    http.Error(w, "Could not list shares", 500)
+    return
+  }
+  result := []ShareJson{}
+  for _, key := range keys {
+    share, err := getShare(strings.TrimSuffix(path.Base(key), ".json"))
+    if err != nil {
+      fmt.Printf("Skipping share %s: %v\n", key, err)
+      continue
+    }
+    if share.Library != lib.Name {
+      continue
+    }
+    result = append(result, share.toJson())
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(result)
+}
+
+func deleteShare(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  share, err := getShare(vars["token"])
+  if err != nil || share.Library != lib.Name {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+  err = storage.Delete(shareKey(vars["token"]))
+  if err != nil {
+    fmt.Printf("Could not delete share: %v\n", err)
+    http.Error(w, "Could not delete share", 500)
+    return
+  }
+  fmt.Fprintf(w, "Deleted")
+}
+
+func shareCookieName(share Share) string {
+  return "va_share_" + share.Token
+}
+
+// shareUnlocked returns true if the share has no password, or r carries
+// the cookie set when the password was entered.
+func shareUnlocked(share Share, r *http.Request) bool {
+  if share.PasswordHash == "" {
+    return true
+  }
+  cookie, err := r.Cookie(shareCookieName(share))
+  if err != nil {
+    return false
+  }
+  return hmac.Equal([]byte(cookie.Value), []byte(signValue(share.Token)))
+}
+
+// loadShare fetches the share named in the URL and opens its library,
+// writing an error and returning false if it doesn't exist or has expired.
+func loadShare(w http.ResponseWriter, r *http.Request) (Share, *Library,
+    bool) {
+  vars := mux.Vars(r)
+  share, err := getShare(vars["token"])
+  if err != nil {
+    http.Error(w, "Not Found", 404)
+    return share, nil, false
+  }
+  if share.expired() {
+    http.Error(w, "This link has expired", 410)
+    return share, nil, false
+  }
+  lib, err := libraries.Open(share.Library)
+  if err != nil {
+    fmt.Printf("Could not open library %q: %v\n", share.Library, err)
+    http.Error(w, "Could not open library", 500)
+    return share, nil, false
+  }
+  return share, lib, true
+}
+
+// shareFileUrl returns a URL for key that works for as long as share does.
+// Storage that can sign URLs is read directly; otherwise the file is
+// streamed through shareFile.
+func shareFileUrl(lib *Library, share Share, key string) string {
+  expires := time.Unix(share.Expires, 0)
+  if limit := time.Now().Add(24 * time.Hour); expires.After(limit) {
+    expires = limit
+  }
+  url := lib.storage.SignedURL(key, expires)
+  if url == "" {
+    url = "/s/" + share.Token + "/file/" + key
+  }
+  return url
+}
+
+type SharedVideo struct {
+  Id string
+  Metadata VideoMetadata
+  ThumbUrl string
+  VideoUrl string
+}
+
+type SharePage struct {
+  Token string
+  Title string
+  Description string
+  Expires string
+  NeedPassword bool
+  WrongPassword bool
+  Videos []SharedVideo
+}
+
+// sharePage renders the read-only player for a share, asking for its
+// password first if it has one.
+func sharePage(w http.ResponseWriter, r *http.Request) {
+  share, lib, ok := loadShare(w, r)
+  if !ok {
+    return
+  }
+
+  page := SharePage{
+    Token: share.Token,
+    Expires: time.Unix(share.Expires, 0).Format("Jan 2, 2006 3:04PM"),
+  }
+  if r.Method == "POST" && share.PasswordHash != "" {
+    err := bcrypt.CompareHashAndPassword([]byte(share.PasswordHash),
+        []byte(r.FormValue("password")))
+    if err == nil {
+      http.SetCookie(w, &http.Cookie{
+        Name: shareCookieName(share),
+        Value: signValue(share.Token),
+        Path: "/s/" + share.Token,
+        Expires: time.Unix(share.Expires, 0),
+        HttpOnly: true,
+      })
+      http.Redirect(w, r, "/s/" + share.Token, 303)
+      return
+    }
+    page.WrongPassword = true
+  }
+  if !shareUnlocked(share, r) {
+    page.NeedPassword = true
+    templates.ExecuteTemplate(w, "share.html", page)
+    return
+  }
+
+  if share.Kind == "album" {
+    album, err := lib.getAlbum(share.TargetId)
+    if err != nil {
+      http.Error(w, "Not Found", 404)
+      return
+    }
+    page.Title = album.Title
+    page.Description = album.Description
+  }
+  videoIds, err := share.videoIds(lib)
+  if err != nil {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+  for _, id := range videoIds {
+    metadata, ok := lib.index.Get(id)
+    if !ok || metadata.Status != "Ready" || metadata.DateDeleted != 0 {
+      continue
+    }
+    page.Videos = append(page.Videos, SharedVideo{
+      Id: id,
+      Metadata: metadata,
+      ThumbUrl: shareFileUrl(lib, share, thumbKey(id)),
+      VideoUrl: shareFileUrl(lib, share, renditionKey(id, "720")),
+    })
+  }
+  if share.Kind == "video" && len(page.Videos) > 0 {
+    page.Title = page.Videos[0].Metadata.Title
+    page.Description = page.Videos[0].Metadata.Description
+  }
+
+  templates.ExecuteTemplate(w, "share.html", page)
+}
+
+// shareFile streams a thumbnail or rendition of one of the share's videos,
+// for storage that can't sign URLs.
+func shareFile(w http.ResponseWriter, r *http.Request) {
+  share, lib, ok := loadShare(w, r)
+  if !ok {
+    return
+  }
+  if !shareUnlocked(share, r) {
+    http.Error(w, "Forbidden", 403)
+    return
+  }
+
+  vars := mux.Vars(r)
+  key := vars["key"]
+  allowed := false
+  videoIds, _ := share.videoIds(lib)
+  for _, id := range videoIds {
+    if key == thumbKey(id) || key == renditionKey(id, "720") {
+      allowed = true
+      break
+    }
+  }
+  if !allowed {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+
+  serveObject(w, r, lib.storage, key)
+}
+
+// serveObject writes the object at key in store, supporting range requests
+// when the storage allows seeking so videos can be scrubbed.
+func serveObject(w http.ResponseWriter, r *http.Request, store Storage,
+    key string) {
+  reader, err := store.GetReader(key)
+  if err != nil {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+  defer reader.Close()
+
+  if seeker, ok := reader.(io.ReadSeeker); ok {
+    http.ServeContent(w, r, path.Base(key), time.Time{}, seeker)
+    return
+  }
+  if path.Ext(key) == ".jpg" {
+    w.Header().Set("Content-Type", "image/jpg")
+  } else {
+    w.Header().Set("Content-Type", "video/mp4")
+  }
+  io.Copy(w, reader)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestInitCookieSecret(t *testing.T) {
+  tests := []struct {
+    secret string
+    ok bool
+  }{
+    {"", true},
+    {"0123456789abcdef0123456789abcdef", true},
+    {"0123456789abcdef", false},
+    {exampleCookieSecret, false},
+  }
+  for _, test := range tests {
+    config.CookieSecret = test.secret
+    cookieSecret = nil
+    err := initCookieSecret()
+    if (err == nil) != test.ok {
+      t.Errorf("initCookieSecret with %q: got error %v, want ok=%v",
+          test.secret, err, test.ok)
+    }
+    if err == nil && len(cookieSecret) < minCookieSecretLength {
+      t.Errorf("initCookieSecret with %q: secret only %d bytes", test.secret,
+          len(cookieSecret))
+    }
+  }
+  config.CookieSecret = ""
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/url"
+  "os"
+  "path"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+  "launchpad.net/goamz/s3"
+)
+
+// Storage is somewhere to keep the archive's objects.  Paths are slash
+// separated keys like "<basename>/metadata.json", with or without a leading
+// slash.
+type Storage interface {
+  Put(path string, data []byte, contType string) error
+  PutReader(path string, r io.Reader, length int64, contType string) error
+
+  // PutReaderClass is PutReader for objects that should be kept in the
+  // given storage class, like S3's STANDARD_IA.  An empty class is the
+  // default one, and stores without classes ignore it.
+  PutReaderClass(path string, r io.Reader, length int64, contType string,
+      class string) error
+
+  // PutMultipart is PutReaderClass for big objects.  S3 sends them in
+  // parts, carrying on with an upload left unfinished at the same path and
+  // skipping the parts it already has, so a restart doesn't start over.
+  PutMultipart(path string, r ReaderAtSeeker, length int64,
+      contType string, class string) error
+  Get(path string) ([]byte, error)
+  GetReader(path string) (io.ReadCloser, error)
+  Delete(path string) error
+
+  // List works like S3's bucket listing: keys under prefix are returned in
+  // order after marker, with keys containing delim after the prefix rolled
+  // up into Prefixes.
+  List(prefix string, delim string, marker string, max int) (*ListResult,
+      error)
+
+  // URL returns where a browser can fetch the object at path.
+  URL(path string) string
+
+  // SignedURL returns a URL for the object at path that works without
+  // logging in until expires, or "" if the storage can't sign URLs.
+  SignedURL(path string, expires time.Time) string
+}
+
+// ReaderAtSeeker can be read in parts, in any order.  *os.File is one.
+type ReaderAtSeeker interface {
+  io.ReaderAt
+  io.ReadSeeker
+}
+
+// ListResult is one page of a listing.  If IsTruncated is set, pass
+// NextMarker to List to get the next page.
+type ListResult struct {
+  Keys []string
+  Prefixes []string
+  IsTruncated bool
+  NextMarker string
+}
+
+// nextMarker returns the last key or prefix in result, which is where the
+// following page starts.
+func (result *ListResult) nextMarker() string {
+  marker := ""
+  if len(result.Keys) > 0 {
+    marker = result.Keys[len(result.Keys) - 1]
+  }
+  if len(result.Prefixes) > 0 {
+    last := result.Prefixes[len(result.Prefixes) - 1]
+    if last > marker {
+      marker = last
+    }
+  }
+  return marker
+}
+
+// listAll pages through every key and prefix in store under prefix.
+func listAll(store Storage, prefix string, delim string) ([]string, []string,
+    error) {
+  var keys, prefixes []string
+  marker := ""
+  for {
+    res, err := store.List(prefix, delim, marker, 1000)
+    if err != nil {
+      return nil, nil, err
+    }
+    keys = append(keys, res.Keys...)
+    prefixes = append(prefixes, res.Prefixes...)
+    if !res.IsTruncated || res.NextMarker == "" {
+      break
+    }
+    marker = res.NextMarker
+  }
+  return keys, prefixes, nil
+}
+
+func newStorage() (Storage, error) {
+  if config.Storage == "local" {
+    return NewLocalStorage(config.LocalStorageDir, "/storage/")
+  } else if config.Storage == "" || config.Storage == "s3" {
+    if config.Private {
+      ttl := time.Duration(config.SignedUrlTtl) * time.Second
+      return &S3Storage{bucket: getS3Bucket(), perm: s3.Private,
+          signedUrlTtl: ttl}, nil
+    }
+    return &S3Storage{bucket: getS3Bucket(), perm: s3.PublicRead}, nil
+  }
+  return nil, fmt.Errorf("Unknown storage %q", config.Storage)
+}
+
+// downloadFile copies the object at key in store to localPath.
+func downloadFile(store Storage, key string, localPath string) error {
+  reader, err := store.GetReader(key)
+  if err != nil {
+    return err
+  }
+  defer reader.Close()
+
+  file, err := os.Create(localPath)
+  if err != nil {
+    return err
+  }
+  _, err = io.Copy(file, reader)
+  closeErr := file.Close()
+  if err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    os.Remove(localPath)
+  }
+  return err
+}
+
+// PrefixStorage keeps objects under prefix in another Storage, so several
+// libraries can share one bucket.
+type PrefixStorage struct {
+  Storage
+  prefix string
+}
+
+func (p *PrefixStorage) key(path string) string {
+  return p.prefix + strings.TrimPrefix(path, "/")
+}
+
+func (p *PrefixStorage) Put(path string, data []byte, contType string) error {
+  return p.Storage.Put(p.key(path), data, contType)
+}
+
+func (p *PrefixStorage) PutReader(path string, r io.Reader, length int64,
+    contType string) error {
+  return p.Storage.PutReader(p.key(path), r, length, contType)
+}
+
+func (p *PrefixStorage) PutReaderClass(path string, r io.Reader,
+    length int64, contType string, class string) error {
+  return p.Storage.PutReaderClass(p.key(path), r, length, contType, class)
+}
+
+func (p *PrefixStorage) PutMultipart(path string, r ReaderAtSeeker,
+    length int64, contType string, class string) error {
+  return p.Storage.PutMultipart(p.key(path), r, length, contType, class)
+}
+
+func (p *PrefixStorage) Get(path string) ([]byte, error) {
+  return p.Storage.Get(p.key(path))
+}
+
+func (p *PrefixStorage) GetReader(path string) (io.ReadCloser, error) {
+  return p.Storage.GetReader(p.key(path))
+}
+
+func (p *PrefixStorage) Delete(path string) error {
+  return p.Storage.Delete(p.key(path))
+}
+
+func (p *PrefixStorage) List(prefix string, delim string, marker string,
+    max int) (*ListResult, error) {
+  if marker != "" {
+    marker = p.key(marker)
+  }
+  res, err := p.Storage.List(p.key(prefix), delim, marker, max)
+  if err != nil {
+    return nil, err
+  }
+  result := &ListResult{IsTruncated: res.IsTruncated}
+  for _, key := range res.Keys {
+    result.Keys = append(result.Keys, strings.TrimPrefix(key, p.prefix))
+  }
+  for _, prefix := range res.Prefixes {
+    result.Prefixes = append(result.Prefixes,
+        strings.TrimPrefix(prefix, p.prefix))
+  }
+  result.NextMarker = strings.TrimPrefix(res.NextMarker, p.prefix)
+  return result, nil
+}
+
+func (p *PrefixStorage) URL(path string) string {
+  return p.Storage.URL(p.key(path))
+}
+
+func (p *PrefixStorage) SignedURL(path string, expires time.Time) string {
+  return p.Storage.SignedURL(p.key(path), expires)
+}
+
+// S3Storage keeps objects in an S3 bucket.  In private mode objects aren't
+// publicly readable, so URL hands out signed URLs that last signedUrlTtl.
+type S3Storage struct {
+  bucket *s3.Bucket
+  perm s3.ACL
+  signedUrlTtl time.Duration
+}
+
+func (s *S3Storage) Put(path string, data []byte, contType string) error {
+  return s.bucket.Put(path, data, contType, s.perm)
+}
+
+func (s *S3Storage) PutReader(path string, r io.Reader, length int64,
+    contType string) error {
+  return s.bucket.PutReader(path, r, length, contType, s.perm)
+}
+
+func (s *S3Storage) PutReaderClass(path string, r io.Reader, length int64,
+    contType string, class string) error {
+  if class == "" {
+    return s.PutReader(path, r, length, contType)
+  }
+  return s.bucket.PutReaderHeader(path, r, length, contType, s.perm,
+      map[string][]string{"x-amz-storage-class": {class}})
+}
+
+func (s *S3Storage) PutMultipart(path string, r ReaderAtSeeker, length int64,
+    contType string, class string) error {
+  path = strings.TrimPrefix(path, "/")
+  multis, _, err := s.bucket.ListMulti(path, "")
+  if err != nil {
+    return err
+  }
+  var multi *s3.Multi
+  for _, m := range multis {
+    if m.Key == path {
+      multi = m
+      fmt.Printf("Resuming multipart upload of %s\n", path)
+      break
+    }
+  }
+  if multi == nil {
+    var headers map[string][]string
+    if class != "" {
+      headers = map[string][]string{"x-amz-storage-class": {class}}
+    }
+    multi, err = s.bucket.InitMultiHeader(path, contType, s.perm, headers)
+    if err != nil {
+      return err
+    }
+  }
+
+  // NOTE: On failure the upload is left for the next attempt to resume
+  parts, err := multi.PutAll(r, partSizeFor(length))
+  if err != nil {
+    return err
+  }
+  return multi.Complete(parts)
+}
+
+func (s *S3Storage) Get(path string) ([]byte, error) {
+  return s.bucket.Get(path)
+}
+
+func (s *S3Storage) GetReader(path string) (io.ReadCloser, error) {
+  return s.bucket.GetReader(path)
+}
+
+func (s *S3Storage) Delete(path string) error {
+  return s.bucket.Del(path)
+}
+
+func (s *S3Storage) List(prefix string, delim string, marker string,
+    max int) (*ListResult, error) {
+  res, err := s.bucket.List(prefix, delim, marker, max)
+  if err != nil {
+    return nil, err
+  }
+  result := &ListResult{
+    Prefixes: res.CommonPrefixes,
+    IsTruncated: res.IsTruncated,
+  }
+  for _, key := range res.Contents {
+    result.Keys = append(result.Keys, key.Key)
+  }
+  // NOTE: goamz doesn't parse S3's NextMarker, but it is always the last
+  //       key or prefix returned
+  if result.IsTruncated {
+    result.NextMarker = result.nextMarker()
+  }
+  return result, nil
+}
+
+func (s *S3Storage) URL(path string) string {
+  if s.perm == s3.Private {
+    return s.bucket.SignedURL(path, time.Now().Add(s.signedUrlTtl))
+  }
+  return s.bucket.URL(path)
+}
+
+func (s *S3Storage) SignedURL(path string, expires time.Time) string {
+  return s.bucket.SignedURL(path, expires)
+}
+
+// LocalStorage keeps objects as files under a directory, which main serves
+// at urlPrefix.
+type LocalStorage struct {
+  dir string
+  urlPrefix string
+}
+
+func NewLocalStorage(dir string, urlPrefix string) (*LocalStorage, error) {
+  err := os.MkdirAll(dir, 0755)
+  if err != nil {
+    return nil, err
+  }
+  return &LocalStorage{dir: dir, urlPrefix: urlPrefix}, nil
+}
+
+// filePath maps key to a file under l.dir.  Cleaning the key as an absolute
+// path first means ".." can never climb out of the directory.
+func (l *LocalStorage) filePath(key string) string {
+  return filepath.Join(l.dir, filepath.FromSlash(path.Clean("/" + key)))
+}
+
+func (l *LocalStorage) Put(path string, data []byte, contType string) error {
+  return l.PutReader(path, bytes.NewReader(data), int64(len(data)), contType)
+}
+
+// PutReader writes to a temporary file and renames it into place, so
+// readers never see a partly written object.
+func (l *LocalStorage) PutReader(key string, r io.Reader, length int64,
+    contType string) error {
+  filePath := l.filePath(key)
+  err := os.MkdirAll(filepath.Dir(filePath), 0755)
+  if err != nil {
+    return err
+  }
+  temp, err := ioutil.TempFile(filepath.Dir(filePath), ".upload-")
+  if err != nil {
+    return err
+  }
+  written, err := io.Copy(temp, r)
+  closeErr := temp.Close()
+  if err == nil {
+    err = closeErr
+  }
+  if err == nil && written != length {
+    err = fmt.Errorf("Wrote %d bytes of %s, expected %d", written, key,
+        length)
+  }
+  if err == nil {
+    err = os.Chmod(temp.Name(), 0644)
+  }
+  if err == nil {
+    err = os.Rename(temp.Name(), filePath)
+  }
+  if err != nil {
+    os.Remove(temp.Name())
+  }
+  return err
+}
+
+func (l *LocalStorage) PutReaderClass(key string, r io.Reader, length int64,
+    contType string, class string) error {
+  return l.PutReader(key, r, length, contType)
+}
+
+func (l *LocalStorage) PutMultipart(key string, r ReaderAtSeeker,
+    length int64, contType string, class string) error {
+  return l.PutReader(key, r, length, contType)
+}
+
+func (l *LocalStorage) Get(key string) ([]byte, error) {
+  return ioutil.ReadFile(l.filePath(key))
+}
+
+func (l *LocalStorage) GetReader(key string) (io.ReadCloser, error) {
+  return os.Open(l.filePath(key))
+}
+
+// Delete removes the object at key.  Like S3, deleting a missing object is
+// not an error.
+func (l *LocalStorage) Delete(key string) error {
+  err := os.Remove(l.filePath(key))
+  if os.IsNotExist(err) {
+    return nil
+  }
+  return err
+}
+
+func (l *LocalStorage) List(prefix string, delim string, marker string,
+    max int) (*ListResult, error) {
+  var keys []string
+  err := filepath.Walk(l.dir, func(filePath string, info os.FileInfo,
+      err error) error {
+    if err != nil {
+      return err
+    }
+    if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+      return nil
+    }
+    rel, err := filepath.Rel(l.dir, filePath)
+    if err != nil {
+      return err
+    }
+    key := filepath.ToSlash(rel)
+    if strings.HasPrefix(key, prefix) {
+      keys = append(keys, key)
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  sort.Strings(keys)
+
+  result := &ListResult{}
+  count := 0
+  for _, key := range keys {
+    entry := key
+    isPrefix := false
+    if delim != "" {
+      i := strings.Index(key[len(prefix):], delim)
+      if i != -1 {
+        entry = key[:len(prefix) + i + len(delim)]
+        isPrefix = true
+      }
+    }
+    if entry <= marker {
+      continue
+    }
+    if isPrefix {
+      numPrefixes := len(result.Prefixes)
+      if numPrefixes > 0 && result.Prefixes[numPrefixes - 1] == entry {
+        continue
+      }
+    }
+    if count == max {
+      result.IsTruncated = true
+      break
+    }
+    if isPrefix {
+      result.Prefixes = append(result.Prefixes, entry)
+    } else {
+      result.Keys = append(result.Keys, entry)
+    }
+    count++
+  }
+  if result.IsTruncated {
+    result.NextMarker = result.nextMarker()
+  }
+  return result, nil
+}
+
+func (l *LocalStorage) URL(key string) string {
+  u := url.URL{Path: l.urlPrefix + strings.TrimPrefix(key, "/")}
+  return u.String()
+}
+
+// SignedURL returns "", since local files are only served through this
+// server.
+func (l *LocalStorage) SignedURL(key string, expires time.Time) string {
+  return ""
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+)
+
+// newTestStorage returns a LocalStorage in a temporary directory holding
+// an object for each of keys.  Call the returned func to remove it.
+func newTestStorage(t *testing.T, keys []string) (*LocalStorage, func()) {
+  dir, err := ioutil.TempDir("", "storage_test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  store, err := NewLocalStorage(dir, "/storage/")
+  if err != nil {
+    os.RemoveAll(dir)
+    t.Fatal(err)
+  }
+  for _, key := range keys {
+    err = store.Put(key, []byte(key), "text/plain")
+    if err != nil {
+      os.RemoveAll(dir)
+      t.Fatal(err)
+    }
+  }
+  return store, func() { os.RemoveAll(dir) }
+}
+
+var testKeys = []string{
+  "a.txt",
+  "b/1.txt",
+  "b/2.txt",
+  "b/c/3.txt",
+  "c.txt",
+  "lib/x/metadata.json",
+  "lib/y/metadata.json",
+}
+
+type listTest struct {
+  prefix string
+  delim string
+  marker string
+  max int
+  want ListResult
+}
+
+func checkList(t *testing.T, store Storage, tests []listTest) {
+  for _, test := range tests {
+    got, err := store.List(test.prefix, test.delim, test.marker, test.max)
+    if err != nil {
+      t.Errorf("List(%q, %q, %q, %d): %v", test.prefix, test.delim,
+          test.marker, test.max, err)
+      continue
+    }
+    if !reflect.DeepEqual(*got, test.want) {
+      t.Errorf("List(%q, %q, %q, %d) = %+v, want %+v", test.prefix,
+          test.delim, test.marker, test.max, *got, test.want)
+    }
+  }
+}
+
+func TestLocalStorageList(t *testing.T) {
+  store, cleanup := newTestStorage(t, testKeys)
+  defer cleanup()
+  // NOTE: Hidden files are partly written objects and never listed
+  err := ioutil.WriteFile(filepath.Join(store.dir, "b", ".upload-1"),
+      []byte("partial"), 0644)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  checkList(t, store, []listTest{
+    {"", "", "", 100, ListResult{Keys: testKeys}},
+    {"", "/", "", 100, ListResult{
+        Keys: []string{"a.txt", "c.txt"},
+        Prefixes: []string{"b/", "lib/"}}},
+    {"b/", "/", "", 100, ListResult{
+        Keys: []string{"b/1.txt", "b/2.txt"},
+        Prefixes: []string{"b/c/"}}},
+    {"b", "", "", 100, ListResult{
+        Keys: []string{"b/1.txt", "b/2.txt", "b/c/3.txt"}}},
+    {"lib/", "/", "", 100, ListResult{
+        Prefixes: []string{"lib/x/", "lib/y/"}}},
+    {"missing/", "/", "", 100, ListResult{}},
+
+    // Paging counts keys and prefixes together, and a prefix used as the
+    // marker skips everything under it
+    {"", "/", "", 2, ListResult{
+        Keys: []string{"a.txt"},
+        Prefixes: []string{"b/"},
+        IsTruncated: true,
+        NextMarker: "b/"}},
+    {"", "/", "b/", 2, ListResult{
+        Keys: []string{"c.txt"},
+        Prefixes: []string{"lib/"}}},
+    {"", "", "b/1.txt", 2, ListResult{
+        Keys: []string{"b/2.txt", "b/c/3.txt"},
+        IsTruncated: true,
+        NextMarker: "b/c/3.txt"}},
+    {"", "", "lib/y/metadata.json", 100, ListResult{}},
+  })
+}
+
+func TestListPaging(t *testing.T) {
+  store, cleanup := newTestStorage(t, testKeys)
+  defer cleanup()
+
+  // NOTE: Paging one entry at a time must visit everything exactly once
+  var keys, prefixes []string
+  marker := ""
+  for pages := 0; pages < 10; pages++ {
+    res, err := store.List("", "/", marker, 1)
+    if err != nil {
+      t.Fatal(err)
+    }
+    keys = append(keys, res.Keys...)
+    prefixes = append(prefixes, res.Prefixes...)
+    if !res.IsTruncated {
+      break
+    }
+    marker = res.NextMarker
+  }
+  if !reflect.DeepEqual(keys, []string{"a.txt", "c.txt"}) ||
+      !reflect.DeepEqual(prefixes, []string{"b/", "lib/"}) {
+    t.Errorf("Paging by one got %v and %v", keys, prefixes)
+  }
+}
+
+func TestPrefixStorageList(t *testing.T) {
+  local, cleanup := newTestStorage(t, testKeys)
+  defer cleanup()
+  store := &PrefixStorage{Storage: local, prefix: "lib/"}
+
+  checkList(t, store, []listTest{
+    {"", "/", "", 100, ListResult{Prefixes: []string{"x/", "y/"}}},
+    {"", "", "", 100, ListResult{
+        Keys: []string{"x/metadata.json", "y/metadata.json"}}},
+    {"/x/", "", "", 100, ListResult{Keys: []string{"x/metadata.json"}}},
+    {"", "/", "", 1, ListResult{
+        Prefixes: []string{"x/"},
+        IsTruncated: true,
+        NextMarker: "x/"}},
+    {"", "/", "x/", 1, ListResult{Prefixes: []string{"y/"}}},
+  })
+}
+
+func TestPrefixStoragePut(t *testing.T) {
+  local, cleanup := newTestStorage(t, nil)
+  defer cleanup()
+  store := &PrefixStorage{Storage: local, prefix: "lib/"}
+
+  err := store.Put("/z/metadata.json", []byte("{}"), "application/json")
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, err := local.Get("lib/z/metadata.json")
+  if err != nil || string(data) != "{}" {
+    t.Errorf("Put under prefix: got %q, %v", data, err)
+  }
+  data, err = store.Get("z/metadata.json")
+  if err != nil || string(data) != "{}" {
+    t.Errorf("Get under prefix: got %q, %v", data, err)
+  }
+  if url := store.URL("z/metadata.json"); url !=
+      "/storage/lib/z/metadata.json" {
+    t.Errorf("URL under prefix: got %q", url)
+  }
+}
+
+func TestLocalStorageStaysInDir(t *testing.T) {
+  store, cleanup := newTestStorage(t, nil)
+  defer cleanup()
+
+  keys := []string{"../escape", "/../../escape", "a/../../escape"}
+  for _, key := range keys {
+    path := store.filePath(key)
+    rel, err := filepath.Rel(store.dir, path)
+    if err != nil || rel != "escape" {
+      t.Errorf("filePath(%q) = %q, outside %q", key, path, store.dir)
+    }
+  }
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "time"
+  "github.com/gorilla/mux"
+)
+
+// trash lists the videos in the trash, taking the same paging parameters as
+// /videos.
+func trash(w http.ResponseWriter, r *http.Request) {
+  listVideos(w, r, VideoFilter{Deleted: true})
+}
+
+func restoreVideo(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  basename := vars["id"]
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  metadata, ok := lib.index.Get(basename)
+  if !ok {
+    http.Error(w, "Not Found", 404)
+    return
+  } else if metadata.DateDeleted == 0 {
+    http.Error(w, "Video is not in the trash", 409)
+    return
+  }
+
+  _, err := lib.updateMetadata(basename, func(metadata *VideoMetadata) error {
+    metadata.DateDeleted = 0
+    return nil
+  })
+  if err != nil {
+    fmt.Printf("Could not restore %s: %v\n", basename, err)
+    http.Error(w, "Could not restore video", 500)
+    return
+  }
+  fmt.Printf("Restored %s from the trash\n", basename)
+  fmt.Fprintf(w, "Restored")
+}
+
+// purgeVideo permanently removes a video and everything stored for it.  The
+// metadata goes last, so if a delete fails the video stays in the trash and
+// the next purge tries again.
+func (lib *Library) purgeVideo(basename string) error {
+  keys := []string{
+    renditionKey(basename, "1080"),
+    renditionKey(basename, "720"),
+    renditionKey(basename, "360"),
+    thumbKey(basename),
+    basename + "/metadata.json",
+  }
+  if metadata, ok := lib.index.Get(basename); ok && metadata.Original != "" {
+    keys = append([]string{metadata.Original}, keys...)
+  }
+  for _, key := range keys {
+    err := lib.storage.Delete(key)
+    if err != nil {
+      return fmt.Errorf("Could not delete %s: %v", key, err)
+    }
+  }
+  lib.removeFromAlbums(basename)
+  return lib.index.Delete(basename)
+}
+
+// purgeTrash permanently removes videos that were put in the trash more
+// than retention ago.
+func (lib *Library) purgeTrash(retention time.Duration) {
+  cutoff := time.Now().Add(-retention).Unix()
+  for _, v := range lib.index.Search(VideoFilter{Deleted: true}) {
+    if v.Metadata.DateDeleted > cutoff {
+      continue
+    }
+    // NOTE: A job still working on the video would write it back
+    if jobQueue.HasActiveJob(lib.Name, v.Id) {
+      continue
+    }
+    err := lib.purgeVideo(v.Id)
+    if err != nil {
+      fmt.Printf("Could not purge %s: %v\n", v.Id, err)
+      continue
+    }
+    fmt.Printf("Purged %s from the trash\n", v.Id)
+  }
+}
+
+// purgeTrashForever empties old videos out of every open library's trash
+// once an hour.
+func purgeTrashForever() {
+  retention := time.Duration(config.TrashRetentionDays) * 24 * time.Hour
+  for {
+    for _, lib := range libraries.List() {
+      lib.purgeTrash(retention)
+    }
+    time.Sleep(time.Hour)
+  }
+}
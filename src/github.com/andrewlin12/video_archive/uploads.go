@@ -0,0 +1,489 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "path"
+  "regexp"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Upload session states.  A session takes chunks while Uploading, and the
+// request that delivers the last chunk moves it to Completing and runs
+// uploadComplete, so each upload is processed exactly once.
+const (
+  UploadUploading = "Uploading"
+  UploadCompleting = "Completing"
+  UploadComplete = "Complete"
+  UploadFailed = "Failed"
+)
+
+// finishedUploadTtl is how long finished sessions are remembered, so a
+// retried last chunk gets the same answer.
+const finishedUploadTtl = time.Hour
+
+// An UploadSession is one resumable.js upload.  It is saved as session.json
+// in the upload's staging folder, so uploads can carry on after a restart.
+type UploadSession struct {
+  Identifier string
+  Username string
+  Library string
+  Filename string
+  ChunkSize int64
+  TotalSize int64
+  TotalChunks int
+  DateStarted int64
+  State string
+  Result UploadResult
+  DateFinished int64 `json:",omitempty"`
+
+  mutex sync.Mutex
+  received map[int]bool
+}
+
+// UploadSessions holds the sessions of uploads in progress.
+type UploadSessions struct {
+  mutex sync.Mutex
+  sessions map[string]*UploadSession
+}
+
+func NewUploadSessions() *UploadSessions {
+  return &UploadSessions{sessions: make(map[string]*UploadSession)}
+}
+
+// An UploadChunkRequest is the resumable.js parameters sent with a chunk
+// or a test for one.
+type UploadChunkRequest struct {
+  Identifier string
+  Filename string
+  ChunkNumber int
+  ChunkSize int64
+  TotalSize int64
+  TotalChunks int
+}
+
+// resumable.js makes identifiers from the file size and name with anything
+// but these characters removed.
+var uploadIdentifierPattern = regexp.MustCompile(`^[0-9A-Za-z_-]{1,200}$`)
+
+func parseUploadChunkRequest(values url.Values) (UploadChunkRequest,
+    error) {
+  req := UploadChunkRequest{
+    Identifier: values.Get("resumableIdentifier"),
+  }
+  if !uploadIdentifierPattern.MatchString(req.Identifier) {
+    return req, fmt.Errorf("Invalid resumableIdentifier")
+  }
+  var ok bool
+  req.Filename, ok = cleanUploadFilename(values.Get("resumableFilename"))
+  if !ok {
+    return req, fmt.Errorf("Invalid resumableFilename")
+  }
+  var err error
+  req.ChunkNumber, err = strconv.Atoi(values.Get("resumableChunkNumber"))
+  if err != nil {
+    return req, fmt.Errorf("Invalid resumableChunkNumber")
+  }
+  req.TotalChunks, err = strconv.Atoi(values.Get("resumableTotalChunks"))
+  if err != nil {
+    return req, fmt.Errorf("Invalid resumableTotalChunks")
+  }
+  req.ChunkSize, err = strconv.ParseInt(values.Get("resumableChunkSize"),
+      10, 64)
+  if err != nil || req.ChunkSize <= 0 {
+    return req, fmt.Errorf("Invalid resumableChunkSize")
+  }
+  req.TotalSize, err = strconv.ParseInt(values.Get("resumableTotalSize"),
+      10, 64)
+  if err != nil || req.TotalSize <= 0 {
+    return req, fmt.Errorf("Invalid resumableTotalSize")
+  }
+
+  // NOTE: resumable.js rounds the chunk count down, folding the remainder
+  //       into the last chunk, unless forceChunkSize is set
+  chunks := req.TotalSize / req.ChunkSize
+  if chunks < 1 {
+    chunks = 1
+  }
+  if req.TotalSize % req.ChunkSize != 0 && int64(req.TotalChunks) ==
+      chunks + 1 {
+    chunks++
+  }
+  if int64(req.TotalChunks) != chunks {
+    return req, fmt.Errorf("resumableTotalChunks doesn't match the sizes")
+  }
+  if req.ChunkNumber < 1 || req.ChunkNumber > req.TotalChunks {
+    return req, fmt.Errorf("resumableChunkNumber out of range")
+  }
+  return req, nil
+}
+
+// cleanUploadFilename strips any folders from the name the browser gave an
+// upload.
+func cleanUploadFilename(filename string) (string, bool) {
+  filename = path.Base(strings.Replace(filename, "\\", "/", -1))
+  if filename == "." || filename == ".." || filename == "/" ||
+      len(filename) > 255 {
+    return "", false
+  }
+  return filename, true
+}
+
+var uploadExtPattern = regexp.MustCompile(`^\.[0-9A-Za-z]{1,10}$`)
+
+// uploadExt returns the extension of filename, if it is safe to use in
+// local paths and storage keys.
+func uploadExt(filename string) string {
+  ext := path.Ext(filename)
+  if !uploadExtPattern.MatchString(ext) {
+    return ""
+  }
+  return ext
+}
+
+// folderPath is where the session's chunks are staged.
+func (session *UploadSession) folderPath() string {
+  // NOTE: Usernames and identifiers can both have underscores, but neither
+  //       can have a plus, so folders for different users can't collide
+  return workPath(fmt.Sprintf("upload_%s+%s", session.Username,
+      session.Identifier))
+}
+
+func (session *UploadSession) chunkPath(chunkNum int) string {
+  return fmt.Sprintf("%s/%08d", session.folderPath(), chunkNum)
+}
+
+// chunkLength returns how many bytes chunk chunkNum must have.
+func (session *UploadSession) chunkLength(chunkNum int) int64 {
+  if chunkNum < session.TotalChunks {
+    return session.ChunkSize
+  }
+  return session.TotalSize - int64(session.TotalChunks - 1) *
+      session.ChunkSize
+}
+
+func (session *UploadSession) matches(req UploadChunkRequest) bool {
+  return session.Filename == req.Filename &&
+      session.ChunkSize == req.ChunkSize &&
+      session.TotalSize == req.TotalSize &&
+      session.TotalChunks == req.TotalChunks
+}
+
+func (session *UploadSession) save() error {
+  data, err := json.Marshal(session)
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(session.folderPath() + "/session.json", data, 0644)
+}
+
+// Open returns the session for user's upload req, picking up one saved
+// before a restart or starting a new one.  A failed session is only started
+// over when retry is set, so stray chunks from the failed attempt don't
+// begin another.
+func (uploads *UploadSessions) Open(user User, req UploadChunkRequest,
+    retry bool) (*UploadSession, error) {
+  uploads.mutex.Lock()
+  defer uploads.mutex.Unlock()
+
+  // Forget sessions that finished a while ago
+  cutoff := time.Now().Add(-finishedUploadTtl).Unix()
+  for key, session := range uploads.sessions {
+    session.mutex.Lock()
+    if session.DateFinished != 0 && session.DateFinished < cutoff {
+      delete(uploads.sessions, key)
+    }
+    session.mutex.Unlock()
+  }
+
+  key := user.Username + "/" + req.Identifier
+  session, ok := uploads.sessions[key]
+  if ok && retry {
+    state, _ := session.status()
+    ok = state != UploadFailed
+  }
+  if !ok {
+    session = &UploadSession{Identifier: req.Identifier,
+        Username: user.Username}
+    data, err := ioutil.ReadFile(session.folderPath() + "/session.json")
+    if err == nil && json.Unmarshal(data, session) == nil &&
+        session.State == UploadUploading && session.matches(req) &&
+        session.Library == user.Library {
+      session.loadReceived()
+      fmt.Printf("Resuming upload %s with %d of %d chunks\n",
+          session.folderPath(), len(session.received), session.TotalChunks)
+    } else {
+      os.RemoveAll(session.folderPath())
+      session = &UploadSession{
+        Identifier: req.Identifier,
+        Username: user.Username,
+        Library: user.Library,
+        Filename: req.Filename,
+        ChunkSize: req.ChunkSize,
+        TotalSize: req.TotalSize,
+        TotalChunks: req.TotalChunks,
+        DateStarted: time.Now().Unix(),
+        State: UploadUploading,
+        received: make(map[int]bool),
+      }
+      err = os.MkdirAll(session.folderPath(), 0700)
+      if err == nil {
+        err = session.save()
+      }
+      if err != nil {
+        return nil, err
+      }
+    }
+    uploads.sessions[key] = session
+  }
+
+  if !session.matches(req) {
+    return nil, fmt.Errorf("Upload %s was started with different sizes",
+        req.Identifier)
+  }
+  return session, nil
+}
+
+// RemoveStale deletes the staging folders of uploads that haven't had a
+// chunk since cutoff, forgetting their sessions.  Uploads that are being
+// completed are left alone.
+func (uploads *UploadSessions) RemoveStale(cutoff time.Time) {
+  uploads.mutex.Lock()
+  defer uploads.mutex.Unlock()
+
+  fileInfos, err := ioutil.ReadDir(config.UploadDir)
+  if err != nil {
+    fmt.Printf("Could not list %s: %v\n", config.UploadDir, err)
+    return
+  }
+  for _, fileInfo := range fileInfos {
+    if !fileInfo.IsDir() || !strings.HasPrefix(fileInfo.Name(), "upload_") ||
+        fileInfo.ModTime().After(cutoff) {
+      continue
+    }
+    folderPath := workPath(fileInfo.Name())
+    var saved UploadSession
+    data, err := ioutil.ReadFile(folderPath + "/session.json")
+    if err == nil {
+      json.Unmarshal(data, &saved)
+    }
+    key := saved.Username + "/" + saved.Identifier
+    session, ok := uploads.sessions[key]
+    if ok {
+      session.mutex.Lock()
+      if session.State == UploadCompleting {
+        session.mutex.Unlock()
+        continue
+      }
+      delete(uploads.sessions, key)
+    }
+    err = os.RemoveAll(folderPath)
+    if ok {
+      session.mutex.Unlock()
+    }
+    if err != nil {
+      fmt.Printf("Could not remove %s: %v\n", folderPath, err)
+      continue
+    }
+    fmt.Printf("Removed stale upload %s\n", folderPath)
+  }
+}
+
+// loadReceived finds the chunks already on disk after a restart.
+func (session *UploadSession) loadReceived() {
+  session.received = make(map[int]bool)
+  for i := 1; i <= session.TotalChunks; i++ {
+    stat, err := os.Stat(session.chunkPath(i))
+    if err == nil && stat.Size() == session.chunkLength(i) {
+      session.received[i] = true
+    }
+  }
+}
+
+// A ChunkLengthError is returned when a chunk isn't the size resumable.js
+// said it would be.
+type ChunkLengthError struct {
+  ChunkNumber int
+  Expected int64
+  Got int64
+}
+
+func (err *ChunkLengthError) Error() string {
+  return fmt.Sprintf("Chunk %d should be %d bytes, not %d", err.ChunkNumber,
+      err.Expected, err.Got)
+}
+
+// writeChunk streams chunk chunkNum to disk, returning true if it was the
+// last one missing, in which case the caller must complete the upload.
+// Chunks that arrive once the upload is complete are ignored.
+func (session *UploadSession) writeChunk(chunkNum int,
+    reader io.Reader) (bool, error) {
+  if state, _ := session.status(); state != UploadUploading {
+    return false, nil
+  }
+
+  // NOTE: Write to a temp file and rename, so a chunk cut off halfway is
+  //       never mistaken for a whole one
+  temp, err := ioutil.TempFile(session.folderPath(),
+      fmt.Sprintf("%08d.part", chunkNum))
+  if err != nil {
+    return false, err
+  }
+  defer os.Remove(temp.Name())
+  length := session.chunkLength(chunkNum)
+  written, err := io.Copy(temp, io.LimitReader(reader, length + 1))
+  closeErr := temp.Close()
+  if err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return false, err
+  }
+  if written != length {
+    return false, &ChunkLengthError{chunkNum, length, written}
+  }
+
+  session.mutex.Lock()
+  defer session.mutex.Unlock()
+  if session.State != UploadUploading {
+    return false, nil
+  }
+  err = os.Rename(temp.Name(), session.chunkPath(chunkNum))
+  if err != nil {
+    return false, err
+  }
+  session.received[chunkNum] = true
+  if len(session.received) < session.TotalChunks {
+    return false, nil
+  }
+  session.State = UploadCompleting
+  return true, nil
+}
+
+// finish records how the upload ended.
+func (session *UploadSession) finish(result UploadResult, err error) {
+  session.mutex.Lock()
+  defer session.mutex.Unlock()
+  session.State = UploadComplete
+  if err != nil {
+    session.State = UploadFailed
+  }
+  session.Result = result
+  session.DateFinished = time.Now().Unix()
+  os.RemoveAll(session.folderPath())
+}
+
+// status returns the session's state and result.
+func (session *UploadSession) status() (string, UploadResult) {
+  session.mutex.Lock()
+  defer session.mutex.Unlock()
+  return session.State, session.Result
+}
+
+// hasChunk returns true if chunkNum doesn't need to be sent (again).
+func (session *UploadSession) hasChunk(chunkNum int) bool {
+  session.mutex.Lock()
+  defer session.mutex.Unlock()
+  return session.State == UploadComplete ||
+      (session.State != UploadFailed && session.received[chunkNum])
+}
+
+// handleUpload takes chunks from resumable.js.  GET tests whether a chunk
+// has already arrived, and POST sends one.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+  user, _ := currentUser(r)
+  lib, ok := requestLibrary(w, r)
+  if !ok {
+    return
+  }
+  if r.Method != "GET" && r.Method != "POST" {
+    http.Error(w, "Unsupported", 405)
+    return
+  }
+
+  // NOTE: Read the form by hand rather than with r.FormFile, which buffers
+  //       the whole chunk.  resumable.js sends the file after the fields.
+  values := r.URL.Query()
+  var file io.Reader
+  if r.Method == "POST" {
+    reader, err := r.MultipartReader()
+    if err != nil {
+      http.Error(w, "Could not read form data", 400)
+      return
+    }
+    for {
+      part, err := reader.NextPart()
+      if err != nil {
+        http.Error(w, "No file in form data", 400)
+        return
+      }
+      if part.FormName() == "file" {
+        file = part
+        break
+      }
+      value, _ := ioutil.ReadAll(io.LimitReader(part, 4096))
+      values.Add(part.FormName(), string(value))
+    }
+  }
+  req, err := parseUploadChunkRequest(values)
+  if err != nil {
+    http.Error(w, err.Error(), 400)
+    return
+  }
+  // NOTE: A new attempt at a file starts by testing for, or sending, its
+  //       first chunk
+  retry := r.Method == "GET" || req.ChunkNumber == 1
+  session, err := uploadSessions.Open(user, req, retry)
+  if err != nil {
+    fmt.Printf("Could not open upload session: %v\n", err)
+    http.Error(w, err.Error(), 409)
+    return
+  }
+
+  if r.Method == "GET" {
+    if !session.hasChunk(req.ChunkNumber) {
+      http.Error(w, "No Content", 204)
+      return
+    }
+    fmt.Fprintf(w, "Found")
+    return
+  }
+
+  last, err := session.writeChunk(req.ChunkNumber, file)
+  if lengthErr, ok := err.(*ChunkLengthError); ok {
+    http.Error(w, lengthErr.Error(), 400)
+    return
+  } else if err != nil {
+    fmt.Printf("Could not write chunk: %v\n", err)
+    http.Error(w, "Could not save chunk", 500)
+    return
+  }
+  if last {
+    force := values.Get("force") == "1"
+    result, err := uploadComplete(lib, session, force)
+    session.finish(result, err)
+    if err != nil {
+      fmt.Printf("Could not complete upload of %s: %v\n", session.Filename,
+          err)
+    }
+  }
+
+  state, result := session.status()
+  switch state {
+  case UploadComplete:
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+  case UploadFailed:
+    http.Error(w, "Could not process upload", 500)
+  default:
+    fmt.Fprintf(w, "Saved")
+  }
+}
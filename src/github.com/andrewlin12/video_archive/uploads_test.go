@@ -0,0 +1,97 @@
+package main
+
+import (
+  "net/url"
+  "testing"
+)
+
+// chunkValues returns valid parameters for the first of two 1MB chunks of
+// a 2.5MB file, with overrides applied.  An empty override removes the
+// parameter.
+func chunkValues(overrides map[string]string) url.Values {
+  values := url.Values{
+    "resumableIdentifier": {"2621440-movie_mp4"},
+    "resumableFilename": {"movie.mp4"},
+    "resumableChunkNumber": {"1"},
+    "resumableTotalChunks": {"2"},
+    "resumableChunkSize": {"1048576"},
+    "resumableTotalSize": {"2621440"},
+  }
+  for name, value := range overrides {
+    if value == "" {
+      values.Del(name)
+    } else {
+      values.Set(name, value)
+    }
+  }
+  return values
+}
+
+func TestParseUploadChunkRequest(t *testing.T) {
+  tests := []struct {
+    name string
+    overrides map[string]string
+    ok bool
+  }{
+    {"valid", nil, true},
+    {"last chunk", map[string]string{"resumableChunkNumber": "2"}, true},
+    {"remainder in its own chunk", map[string]string{
+        "resumableTotalChunks": "3", "resumableChunkNumber": "3"}, true},
+    {"file smaller than a chunk", map[string]string{
+        "resumableTotalSize": "10", "resumableTotalChunks": "1"}, true},
+    {"exact multiple", map[string]string{
+        "resumableTotalSize": "2097152"}, true},
+    {"missing identifier", map[string]string{"resumableIdentifier": ""},
+        false},
+    {"identifier with slash", map[string]string{
+        "resumableIdentifier": "../etc"}, false},
+    {"missing filename", map[string]string{"resumableFilename": ""}, false},
+    {"filename is a folder", map[string]string{"resumableFilename": "a/"},
+        true},
+    {"filename is root", map[string]string{"resumableFilename": "/"}, false},
+    {"chunk number zero", map[string]string{"resumableChunkNumber": "0"},
+        false},
+    {"chunk number past the end", map[string]string{
+        "resumableChunkNumber": "3"}, false},
+    {"chunk number not a number", map[string]string{
+        "resumableChunkNumber": "one"}, false},
+    {"zero chunk size", map[string]string{"resumableChunkSize": "0"}, false},
+    {"negative total size", map[string]string{"resumableTotalSize": "-1"},
+        false},
+    {"too many chunks", map[string]string{"resumableTotalChunks": "4"},
+        false},
+    {"too few chunks", map[string]string{"resumableTotalChunks": "1"},
+        false},
+    {"extra chunk for an exact multiple", map[string]string{
+        "resumableTotalSize": "2097152", "resumableTotalChunks": "3"}, false},
+  }
+  for _, test := range tests {
+    _, err := parseUploadChunkRequest(chunkValues(test.overrides))
+    if (err == nil) != test.ok {
+      t.Errorf("%s: got error %v, want ok=%v", test.name, err, test.ok)
+    }
+  }
+}
+
+func TestCleanUploadFilename(t *testing.T) {
+  tests := []struct {
+    filename string
+    want string
+    ok bool
+  }{
+    {"movie.mp4", "movie.mp4", true},
+    {"/home/me/movie.mp4", "movie.mp4", true},
+    {"C:\\Users\\me\\movie.mp4", "movie.mp4", true},
+    {"../../movie.mp4", "movie.mp4", true},
+    {"..", "", false},
+    {"", "", false},
+    {"/", "", false},
+  }
+  for _, test := range tests {
+    got, ok := cleanUploadFilename(test.filename)
+    if got != test.want || ok != test.ok {
+      t.Errorf("cleanUploadFilename(%q) = %q, %v; want %q, %v", test.filename,
+          got, ok, test.want, test.ok)
+    }
+  }
+}
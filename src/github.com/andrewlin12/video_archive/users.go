@@ -0,0 +1,133 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "github.com/gorilla/mux"
+)
+
+// UserJson is a user as returned by the API, without their password hash.
+type UserJson struct {
+  Username string
+  Role string
+  Library string
+}
+
+// A UserEdit is the body of POST /users and PUT /users/{name}.  When
+// updating, empty fields are not changed.  New users without a Library get
+// the one defaultLibrary picks; "" is the default library.
+type UserEdit struct {
+  Username string
+  Password string
+  Role string
+  Library *string
+}
+
+func (user User) toJson() UserJson {
+  return UserJson{
+    Username: user.Username,
+    Role: user.Role,
+    Library: user.Library,
+  }
+}
+
+// me returns the logged in user, so pages can hide what they can't do.
+func me(w http.ResponseWriter, r *http.Request) {
+  user, _ := currentUser(r)
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(user.toJson())
+}
+
+func listUsers(w http.ResponseWriter, r *http.Request) {
+  result := []UserJson{}
+  for _, user := range users.List() {
+    result = append(result, user.toJson())
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(result)
+}
+
+func readUserEdit(w http.ResponseWriter, r *http.Request) (UserEdit, bool) {
+  var edit UserEdit
+  err := json.NewDecoder(io.LimitReader(r.Body, 64 * 1024)).Decode(&edit)
+  if err != nil {
+    http.Error(w, "Invalid JSON body", 400)
+    return edit, false
+  }
+  return edit, true
+}
+
+func createUser(w http.ResponseWriter, r *http.Request) {
+  edit, ok := readUserEdit(w, r)
+  if !ok {
+    return
+  }
+  if _, exists := users.Get(edit.Username); exists {
+    http.Error(w, "User already exists", 409)
+    return
+  }
+  if edit.Library == nil {
+    edit.Library = defaultLibrary()
+  }
+  user, err := users.Update(edit.Username, edit.Password, edit.Role,
+      edit.Library)
+  if err != nil {
+    http.Error(w, err.Error(), 400)
+    return
+  }
+  admin, _ := currentUser(r)
+  fmt.Printf("%s added user %s (%s)\n", admin.Username, user.Username,
+      user.Role)
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(201)
+  json.NewEncoder(w).Encode(user.toJson())
+}
+
+func editUser(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  edit, ok := readUserEdit(w, r)
+  if !ok {
+    return
+  }
+  if _, exists := users.Get(vars["name"]); !exists {
+    http.Error(w, "Not Found", 404)
+    return
+  }
+  user, err := users.Update(vars["name"], edit.Password, edit.Role,
+      edit.Library)
+  if err == ErrLastAdmin {
+    http.Error(w, err.Error(), 409)
+    return
+  } else if err != nil {
+    http.Error(w, err.Error(), 400)
+    return
+  }
+  admin, _ := currentUser(r)
+  fmt.Printf("%s updated user %s (%s)\n", admin.Username, user.Username,
+      user.Role)
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(user.toJson())
+}
+
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  err := users.Delete(vars["name"])
+  if err == ErrNoUser {
+    http.Error(w, "Not Found", 404)
+    return
+  } else if err == ErrLastAdmin {
+    http.Error(w, err.Error(), 409)
+    return
+  } else if err != nil {
+    fmt.Printf("Could not delete user: %v\n", err)
+    http.Error(w, "Could not delete user", 500)
+    return
+  }
+  admin, _ := currentUser(r)
+  fmt.Printf("%s deleted user %s\n", admin.Username, vars["name"])
+  fmt.Fprintf(w, "Deleted")
+}
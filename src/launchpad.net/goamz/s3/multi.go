@@ -8,8 +8,10 @@ import (
 	"encoding/xml"
 	"errors"
 	"io"
+	"net/url"
 	"sort"
 	"strconv"
+	"time"
 )
 
 // Multi represents an unfinished multipart upload.
@@ -23,6 +25,9 @@ type Multi struct {
 	Bucket   *Bucket
 	Key      string
 	UploadId string
+
+	// Initiated is when the upload was started, as reported by ListMulti.
+	Initiated string
 }
 
 // That's the default. Here just for testing.
@@ -106,11 +111,20 @@ func (b *Bucket) Multi(key, contType string, perm ACL) (*Multi, error) {
 //
 // See http://goo.gl/XP8kL for details.
 func (b *Bucket) InitMulti(key string, contType string, perm ACL) (*Multi, error) {
+	return b.InitMultiHeader(key, contType, perm, nil)
+}
+
+// InitMultiHeader is like InitMulti, but sends the extra headers too,
+// e.g. x-amz-storage-class.
+func (b *Bucket) InitMultiHeader(key string, contType string, perm ACL, extra map[string][]string) (*Multi, error) {
 	headers := map[string][]string{
 		"Content-Type":   {contType},
 		"Content-Length": {"0"},
 		"x-amz-acl":      {string(perm)},
 	}
+	for k, v := range extra {
+		headers[k] = v
+	}
 	params := map[string][]string{
 		"uploads": {""},
 	}
@@ -137,6 +151,31 @@ func (b *Bucket) InitMulti(key string, contType string, perm ACL) (*Multi, error
 	return &Multi{Bucket: b, Key: key, UploadId: resp.UploadId}, nil
 }
 
+// SignedURL returns a URL that allows anyone holding it to PUT part n of
+// the multipart upload until expires. The request must not carry a
+// Content-Type or Content-MD5 header, as those are not signed.
+func (m *Multi) SignedURL(n int, expires time.Time) string {
+	req := &request{
+		method: "PUT",
+		bucket: m.Bucket.Name,
+		path:   m.Key,
+		params: url.Values{
+			"Expires":    {strconv.FormatInt(expires.Unix(), 10)},
+			"partNumber": {strconv.FormatInt(int64(n), 10)},
+			"uploadId":   {m.UploadId},
+		},
+	}
+	err := m.Bucket.S3.prepare(req)
+	if err != nil {
+		panic(err)
+	}
+	u, err := req.url()
+	if err != nil {
+		panic(err)
+	}
+	return u.String()
+}
+
 // PutPart sends part n of the multipart upload, reading all the content from r.
 // Each part, except for the last one, must be at least 5MB in size.
 //
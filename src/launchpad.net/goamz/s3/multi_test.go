@@ -357,6 +357,7 @@ func (s *S) TestListMulti(c *C) {
 	c.Assert(multis, HasLen, 2)
 	c.Assert(multis[0].Key, Equals, "multi1")
 	c.Assert(multis[0].UploadId, Equals, "iUVug89pPvSswrikD")
+	c.Assert(multis[0].Initiated, Equals, "2013-01-30T18:15:47.000Z")
 	c.Assert(multis[1].Key, Equals, "multi2")
 	c.Assert(multis[1].UploadId, Equals, "DkirwsSvPp98guVUi")
 
@@ -191,11 +191,20 @@ func (b *Bucket) Put(path string, data []byte, contType string, perm ACL) error
 // PutReader inserts an object into the S3 bucket by consuming data
 // from r until EOF.
 func (b *Bucket) PutReader(path string, r io.Reader, length int64, contType string, perm ACL) error {
+	return b.PutReaderHeader(path, r, length, contType, perm, nil)
+}
+
+// PutReaderHeader is like PutReader, but also sends the given extra
+// headers, such as x-amz-storage-class.
+func (b *Bucket) PutReaderHeader(path string, r io.Reader, length int64, contType string, perm ACL, extra map[string][]string) error {
 	headers := map[string][]string{
 		"Content-Length": {strconv.FormatInt(length, 10)},
 		"Content-Type":   {contType},
 		"x-amz-acl":      {string(perm)},
 	}
+	for k, v := range extra {
+		headers[k] = v
+	}
 	req := &request{
 		method:  "PUT",
 		bucket:  b.Name,